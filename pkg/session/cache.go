@@ -0,0 +1,506 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "maps"
+    "slices"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+// invalidationChannel is the pub/sub channel of the near-cache, prefixed with the App
+const invalidationChannel = "session_invalidate"
+
+// maxCacheSize bounds the number of sessions the per-process cache holds
+const maxCacheSize = 10000
+
+// evictDivisor sets the share of a full per-process cache that is evicted
+// when no entry expired: the oldest quarter
+const evictDivisor = 4
+
+// CachedStoreConfig defines the config for the near-cache
+type CachedStoreConfig struct {
+    // TTL is how long a session stays in the per-process cache, 0 disables
+    // it and only the per-request cache is used. It bounds how long a read
+    // may miss a change, e.g. an expiry, that was not published.
+    TTL time.Duration
+
+    MaxEntries       int           // size of the per-process cache, defaults to 10000
+    ReconnectBackoff time.Duration // initial delay before resubscribing, defaults to 1s
+}
+
+// CacheStats are the counters of a CachedStore
+type CacheStats struct {
+    RequestHits   uint64 // reads served by the per-request cache
+    LocalHits     uint64 // reads served by the per-process cache
+    Misses        uint64 // reads that went to Redis
+    Invalidations uint64 // sessions dropped after a write, here or in another process
+    Evictions     uint64 // sessions dropped because the cache was full
+}
+
+// HitRate returns the share of reads served from a cache
+func (s CacheStats) HitRate() float64 {
+    hits := s.RequestHits + s.LocalHits
+    if hits+s.Misses == 0 {
+        return 0
+    }
+    return float64(hits) / float64(hits+s.Misses)
+}
+
+// cacheEntry is a session in the per-process cache
+type cacheEntry struct {
+    values  map[string]string
+    expires time.Time
+}
+
+// requestCache holds the sessions read during a request
+type requestCache map[string]map[string]string
+
+// CachedStore is a near-cache around a SessionManager. Reads are served from
+// a snapshot of the whole session, kept for the rest of the request and, while
+// Run is subscribed, for TTL in the process. Every write through the store
+// drops the session here and publishes its key, so the other processes drop
+// it too, except the last access a Touch keeps up to date. Writes that bypass
+// the CachedStore are only seen after TTL.
+type CachedStore struct {
+    *SessionManager
+
+    config CachedStoreConfig
+
+    mu      sync.Mutex
+    entries map[string]cacheEntry
+
+    // epoch is bumped by every invalidation, so a read that raced with one
+    // does not put its result into the cache
+    epoch      atomic.Uint64
+    subscribed atomic.Bool
+
+    requestHits   atomic.Uint64
+    localHits     atomic.Uint64
+    misses        atomic.Uint64
+    invalidations atomic.Uint64
+    evictions     atomic.Uint64
+}
+
+// NewCachedStore creates a near-cache around sm. Call Run in its own
+// goroutine to enable the per-process cache.
+func NewCachedStore(sm *SessionManager, config CachedStoreConfig) *CachedStore {
+    if config.MaxEntries <= 0 {
+        config.MaxEntries = maxCacheSize
+    }
+    if config.ReconnectBackoff <= 0 {
+        config.ReconnectBackoff = time.Second
+    }
+
+    return &CachedStore{
+        SessionManager: sm,
+        config:         config,
+        entries:        make(map[string]cacheEntry),
+    }
+}
+
+// Stats returns the current counters
+func (cs *CachedStore) Stats() CacheStats {
+    return CacheStats{
+        RequestHits:   cs.requestHits.Load(),
+        LocalHits:     cs.localHits.Load(),
+        Misses:        cs.misses.Load(),
+        Invalidations: cs.invalidations.Load(),
+        Evictions:     cs.evictions.Load(),
+    }
+}
+
+// channel returns the invalidation channel
+func (cs *CachedStore) channel() string {
+    return keyNamespace(cs.App, "") + invalidationChannel
+}
+
+// localEnabled reports whether the per-process cache may be used. Without
+// a subscription, changes made by other processes would go unnoticed.
+func (cs *CachedStore) localEnabled() bool {
+    return cs.config.TTL > 0 && cs.subscribed.Load()
+}
+
+// requestCacheFrom returns the per-request cache, or nil outside a request
+func (cs *CachedStore) requestCacheFrom(ctx context.Context) requestCache {
+    c, ok := FiberCtxFrom(ctx)
+    if !ok {
+        return nil
+    }
+
+    cache, _ := c.Locals(cs).(requestCache)
+    if cache == nil {
+        cache = make(requestCache)
+        c.Locals(cs, cache)
+    }
+    return cache
+}
+
+// session returns the fields of a session, from a cache if possible. The
+// returned map is shared and must not be modified.
+func (cs *CachedStore) session(ctx context.Context, sessionID string) (map[string]string, error) {
+    fullKey := cs.key(ctx, sessionID)
+    reqCache := cs.requestCacheFrom(ctx)
+
+    if values, ok := reqCache[fullKey]; ok {
+        cs.requestHits.Add(1)
+        return values, nil
+    }
+
+    if cs.localEnabled() {
+        now := time.Now()
+
+        cs.mu.Lock()
+        entry, ok := cs.entries[fullKey]
+        cs.mu.Unlock()
+
+        if ok && now.Before(entry.expires) {
+            cs.localHits.Add(1)
+            if reqCache != nil {
+                reqCache[fullKey] = entry.values
+            }
+            return entry.values, nil
+        }
+    }
+
+    cs.misses.Add(1)
+    epoch := cs.epoch.Load()
+
+    values, err := cs.SessionManager.HGetAll(ctx, sessionID)
+    if err != nil {
+        return nil, err
+    }
+
+    if reqCache != nil {
+        reqCache[fullKey] = values
+    }
+    if cs.localEnabled() {
+        cs.store(fullKey, values, epoch)
+    }
+
+    return values, nil
+}
+
+// store puts a session into the per-process cache unless it was invalidated
+// since epoch, making room if the cache is full
+func (cs *CachedStore) store(fullKey string, values map[string]string, epoch uint64) {
+    now := time.Now()
+
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    if cs.epoch.Load() != epoch {
+        return
+    }
+
+    if _, ok := cs.entries[fullKey]; !ok && len(cs.entries) >= cs.config.MaxEntries {
+        cs.evict(now)
+    }
+
+    cs.entries[fullKey] = cacheEntry{values: values, expires: now.Add(cs.config.TTL)}
+}
+
+// evict drops the expired entries of the full per-process cache, and if none
+// expired, the oldest ones. Entries share the TTL, so the oldest expire first.
+// The caller holds mu.
+func (cs *CachedStore) evict(now time.Time) {
+    before := len(cs.entries)
+
+    for k, entry := range cs.entries {
+        if !now.Before(entry.expires) {
+            delete(cs.entries, k)
+        }
+    }
+
+    if len(cs.entries) >= cs.config.MaxEntries {
+        keys := slices.Collect(maps.Keys(cs.entries))
+        slices.SortFunc(keys, func(a, b string) int {
+            return cs.entries[a].expires.Compare(cs.entries[b].expires)
+        })
+        for _, k := range keys[:max(len(keys)/evictDivisor, 1)] {
+            delete(cs.entries, k)
+        }
+    }
+
+    cs.evictions.Add(uint64(before - len(cs.entries)))
+}
+
+// drop removes sessions from the per-process cache
+func (cs *CachedStore) drop(fullKeys ...string) {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+
+    cs.epoch.Add(1)
+    for _, fullKey := range fullKeys {
+        if _, ok := cs.entries[fullKey]; ok {
+            delete(cs.entries, fullKey)
+            cs.invalidations.Add(1)
+        }
+    }
+}
+
+// invalidate drops sessions that were written from both caches and tells the
+// other processes to drop them. The write already happened, so a failed
+// publish is only logged.
+func (cs *CachedStore) invalidate(ctx context.Context, sessionIDs ...string) {
+    fullKeys := make([]string, len(sessionIDs))
+    for i, sessionID := range sessionIDs {
+        fullKeys[i] = cs.key(ctx, sessionID)
+    }
+
+    reqCache := cs.requestCacheFrom(ctx)
+    for _, fullKey := range fullKeys {
+        delete(reqCache, fullKey)
+    }
+
+    cs.drop(fullKeys...)
+
+    if cs.config.TTL <= 0 {
+        return
+    }
+
+    pipe := cs.RedisClient.Pipeline()
+    for _, fullKey := range fullKeys {
+        pipe.Publish(ctx, cs.channel(), fullKey)
+    }
+    if _, err := pipe.Exec(ctx); err != nil {
+        logx.Warn(ctx, "failed to publish session invalidation: %v", err)
+    }
+}
+
+// Run subscribes to the invalidations of the other processes until ctx is
+// done, reconnecting after a dropped connection. The per-process cache is
+// only used while subscribed. It returns nil on shutdown.
+func (cs *CachedStore) Run(ctx context.Context) error {
+    if cs.RedisClient == nil {
+        return errors.New("cached store has no redis client")
+    }
+
+    backoff := cs.config.ReconnectBackoff
+
+    for {
+        subscribed, err := cs.listen(ctx)
+        if ctx.Err() != nil {
+            return nil
+        }
+        if subscribed {
+            backoff = cs.config.ReconnectBackoff
+        }
+
+        logx.Warn(ctx, "session cache invalidation disconnected, retrying in %s: %v", backoff, err)
+
+        timer := time.NewTimer(backoff)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return nil
+        case <-timer.C:
+        }
+
+        backoff *= 2
+        if backoff > maxReconnectBackoff {
+            backoff = maxReconnectBackoff
+        }
+    }
+}
+
+// listen runs a single subscription. Invalidations may have been missed
+// before it, so the cache starts out empty.
+func (cs *CachedStore) listen(ctx context.Context) (bool, error) {
+    pubsub := cs.RedisClient.Subscribe(ctx, cs.channel())
+    defer pubsub.Close()
+
+    defer cs.subscribed.Store(false)
+
+    if _, err := pubsub.Receive(ctx); err != nil {
+        return false, fmt.Errorf("failed to subscribe to session invalidations: %w", err)
+    }
+
+    cs.mu.Lock()
+    cs.epoch.Add(1)
+    clear(cs.entries)
+    cs.mu.Unlock()
+    cs.subscribed.Store(true)
+
+    for {
+        msg, err := pubsub.ReceiveMessage(ctx)
+        if err != nil {
+            return true, err
+        }
+        cs.drop(msg.Payload)
+    }
+}
+
+// Load loads a raw value from the cached session, see SessionManager.Load
+func (cs *CachedStore) Load(ctx context.Context, sessionID, key string) ([]byte, error) {
+    value, err := cs.HGet(ctx, sessionID, key)
+    if err != nil {
+        return nil, err
+    }
+
+    payload, err := valuePayload([]byte(value))
+    if err != nil {
+        return nil, fmt.Errorf("failed to load session data: %w", err)
+    }
+    return payload, nil
+}
+
+// LoadJSON decodes a Go value from the cached session
+func (cs *CachedStore) LoadJSON(ctx context.Context, sessionID, key string, dest any) error {
+    value, err := cs.HGet(ctx, sessionID, key)
+    if err != nil {
+        return err
+    }
+    return cs.decodeValue([]byte(value), dest)
+}
+
+// HGetAll gets all fields from the cached session
+func (cs *CachedStore) HGetAll(ctx context.Context, sessionID string) (map[string]string, error) {
+    values, err := cs.session(ctx, sessionID)
+    if err != nil {
+        return nil, err
+    }
+    return maps.Clone(values), nil
+}
+
+// HGet gets a single field from the cached session
+func (cs *CachedStore) HGet(ctx context.Context, sessionID, key string) (string, error) {
+    values, err := cs.session(ctx, sessionID)
+    if err != nil {
+        return "", err
+    }
+
+    value, ok := values[key]
+    if !ok {
+        return "", &notFoundError{key: key}
+    }
+    return value, nil
+}
+
+// Save saves a Go value into the session and invalidates it
+func (cs *CachedStore) Save(ctx context.Context, sessionID, key string, value any) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.Save(ctx, sessionID, key, value)
+}
+
+// Delete deletes a key from the session and invalidates it
+func (cs *CachedStore) Delete(ctx context.Context, sessionID, key string) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.Delete(ctx, sessionID, key)
+}
+
+// Clear deletes the entire session and invalidates it
+func (cs *CachedStore) Clear(ctx context.Context, sessionID string) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.Clear(ctx, sessionID)
+}
+
+// HSet sets multiple fields in the session and invalidates it
+func (cs *CachedStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.HSet(ctx, sessionID, values)
+}
+
+// Expire sets an expiration time for the session. A TTL that is not
+// positive deletes the session, which invalidates it.
+func (cs *CachedStore) Expire(ctx context.Context, sessionID string, expiration time.Duration) error {
+    if expiration <= 0 {
+        defer cs.invalidate(ctx, sessionID)
+    }
+    return cs.SessionManager.Expire(ctx, sessionID, expiration)
+}
+
+// RotateSession moves a session to a new ID and invalidates both
+func (cs *CachedStore) RotateSession(ctx context.Context, oldSessionID, newSessionID string, opts RotateOptions) (string, error) {
+    target, err := cs.SessionManager.RotateSession(ctx, oldSessionID, newSessionID, opts)
+    if err == nil && target != newSessionID {
+        cs.invalidate(ctx, oldSessionID, newSessionID, target)
+    } else {
+        cs.invalidate(ctx, oldSessionID, newSessionID)
+    }
+    return target, err
+}
+
+// Touch runs on Redis, the session is invalidated if fields were written
+func (cs *CachedStore) Touch(ctx context.Context, sessionID string, opts TouchOptions) (TouchResult, error) {
+    result, err := cs.SessionManager.Touch(ctx, sessionID, opts)
+    if result.Matched {
+        cs.touched(ctx, sessionID, opts.Set)
+    }
+    return result, err
+}
+
+// touched updates the caches after a touch wrote fields. The last access
+// the middleware writes on every request is set in the cached session of
+// this process instead, invalidating it would leave nothing to cache. Other
+// processes keep their older copy until TTL, the middleware reads the last
+// access through Touch, which bypasses the caches.
+func (cs *CachedStore) touched(ctx context.Context, sessionID string, set map[string]string) {
+    if len(set) == 0 {
+        return
+    }
+    for field := range set {
+        if field != lastAccessField {
+            cs.invalidate(ctx, sessionID)
+            return
+        }
+    }
+
+    fullKey := cs.key(ctx, sessionID)
+    patch := func(values map[string]string) map[string]string {
+        values = maps.Clone(values)
+        maps.Copy(values, set)
+        return values
+    }
+
+    if reqCache := cs.requestCacheFrom(ctx); reqCache != nil {
+        if values, ok := reqCache[fullKey]; ok {
+            reqCache[fullKey] = patch(values)
+        }
+    }
+
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    if entry, ok := cs.entries[fullKey]; ok {
+        entry.values = patch(entry.values)
+        cs.entries[fullKey] = entry
+    }
+}
+
+// Update runs on Redis and invalidates the session
+func (cs *CachedStore) Update(ctx context.Context, sessionID, key string, fn func(old []byte) ([]byte, error)) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.Update(ctx, sessionID, key, fn)
+}
+
+// UpdateSession runs on Redis and invalidates the session
+func (cs *CachedStore) UpdateSession(ctx context.Context, sessionID string, fn func(values map[string]string) error) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.UpdateSession(ctx, sessionID, fn)
+}
+
+// BindUser binds a session to a user and invalidates it
+func (cs *CachedStore) BindUser(ctx context.Context, sessionID, userID string) error {
+    defer cs.invalidate(ctx, sessionID)
+    return cs.SessionManager.BindUser(ctx, sessionID, userID)
+}
+
+// RevokeUserSessions deletes every session of a user and invalidates them
+func (cs *CachedStore) RevokeUserSessions(ctx context.Context, userID string) error {
+    return cs.RevokeAllExcept(ctx, userID, "")
+}
+
+// RevokeAllExcept deletes every session of a user but currentSessionID and
+// invalidates them
+func (cs *CachedStore) RevokeAllExcept(ctx context.Context, userID, currentSessionID string) error {
+    revoked, err := cs.revokeAllExcept(ctx, userID, currentSessionID)
+    if len(revoked) > 0 {
+        cs.invalidate(ctx, revoked...)
+    }
+    return err
+}
@@ -0,0 +1,204 @@
+package sessionutils
+
+import (
+    "context"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/valyala/fasthttp"
+)
+
+func TestCachedStoreEntries(t *testing.T) {
+    cs := NewCachedStore(&SessionManager{}, CachedStoreConfig{TTL: time.Minute, MaxEntries: 2})
+
+    epoch := cs.epoch.Load()
+    cs.store("session:a", map[string]string{"k": "a"}, epoch)
+    cs.store("session:b", map[string]string{"k": "b"}, epoch)
+    if len(cs.entries) != 2 {
+        t.Fatalf("entries = %d; want 2", len(cs.entries))
+    }
+
+    // A read that raced with an invalidation is not cached
+    cs.drop("session:a")
+    cs.store("session:a", map[string]string{"k": "stale"}, epoch)
+    if _, ok := cs.entries["session:a"]; ok {
+        t.Errorf("stale read was cached")
+    }
+
+    // A full cache without expired entries evicts its oldest entries
+    epoch = cs.epoch.Load()
+    cs.store("session:a", map[string]string{"k": "a"}, epoch)
+    cs.store("session:c", map[string]string{"k": "c"}, epoch)
+    if _, ok := cs.entries["session:b"]; ok || len(cs.entries) != 2 {
+        t.Errorf("entries after eviction = %v; want session:a and session:c", cs.entries)
+    }
+
+    stats := cs.Stats()
+    if stats.Invalidations != 1 || stats.Evictions != 1 {
+        t.Errorf("Stats() = %+v; want 1 invalidation and 1 eviction", stats)
+    }
+}
+
+func TestCacheStatsHitRate(t *testing.T) {
+    tests := []struct {
+        stats CacheStats
+        want  float64
+    }{
+        {CacheStats{}, 0},
+        {CacheStats{Misses: 4}, 0},
+        {CacheStats{RequestHits: 1, LocalHits: 2, Misses: 1}, 0.75},
+    }
+
+    for _, tt := range tests {
+        if got := tt.stats.HitRate(); got != tt.want {
+            t.Errorf("%+v.HitRate() = %v; want %v", tt.stats, got, tt.want)
+        }
+    }
+}
+
+func TestCachedStore(t *testing.T) {
+    server := newFakeRedis(t)
+    ctx, cancel := context.WithCancel(context.Background())
+
+    // Two processes sharing the Redis database
+    newProcess := func() *CachedStore {
+        sm := NewSessionManager(server.client())
+        sm.App = "shop"
+        return NewCachedStore(sm, CachedStoreConfig{TTL: time.Minute, ReconnectBackoff: 10 * time.Millisecond})
+    }
+    local, remote := newProcess(), newProcess()
+
+    var wg sync.WaitGroup
+    for _, cs := range []*CachedStore{local, remote} {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            cs.Run(ctx)
+        }()
+    }
+    defer func() {
+        cancel()
+        server.Close()
+        wg.Wait()
+    }()
+
+    waitFor := func(what string, cond func() bool) {
+        t.Helper()
+        for deadline := time.Now().Add(5 * time.Second); !cond(); {
+            if time.Now().After(deadline) {
+                t.Fatalf("timed out waiting for %s", what)
+            }
+            time.Sleep(5 * time.Millisecond)
+        }
+    }
+    waitFor("the subscriptions", func() bool {
+        return local.localEnabled() && remote.localEnabled()
+    })
+
+    if err := local.HSet(ctx, "abc", map[string]string{"cart": "apple"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    t.Run("RequestCache", func(t *testing.T) {
+        app := fiber.New()
+        c := app.AcquireCtx(&fasthttp.RequestCtx{})
+        defer app.ReleaseCtx(c)
+        reqCtx := WithFiberCtx(ctx, c)
+
+        reads := server.Calls("HGETALL")
+        for range 3 {
+            if value, err := local.HGet(reqCtx, "abc", "cart"); err != nil || value != "apple" {
+                t.Fatalf("HGet() = %q, %v; want apple", value, err)
+            }
+        }
+        if got := server.Calls("HGETALL") - reads; got != 1 {
+            t.Errorf("Redis reads for one request = %d; want 1", got)
+        }
+        if stats := local.Stats(); stats.RequestHits != 2 {
+            t.Errorf("request hits = %d; want 2", stats.RequestHits)
+        }
+    })
+
+    t.Run("Invalidation", func(t *testing.T) {
+        if value, err := remote.HGet(ctx, "abc", "cart"); err != nil || value != "apple" {
+            t.Fatalf("HGet() = %q, %v; want apple", value, err)
+        }
+        reads := server.Calls("HGETALL")
+        if _, err := remote.HGet(ctx, "abc", "cart"); err != nil || server.Calls("HGETALL") != reads {
+            t.Errorf("second read was not served by the process cache")
+        }
+
+        // A write in one process drops the session in the other
+        invalidations := remote.Stats().Invalidations
+        if err := local.HSet(ctx, "abc", map[string]string{"cart": "pear"}); err != nil {
+            t.Fatalf("HSet() error = %v", err)
+        }
+        waitFor("the invalidation", func() bool {
+            return remote.Stats().Invalidations > invalidations
+        })
+        if value, err := remote.HGet(ctx, "abc", "cart"); err != nil || value != "pear" {
+            t.Errorf("HGet() after invalidation = %q, %v; want pear", value, err)
+        }
+    })
+
+    t.Run("RevokeAllExcept", func(t *testing.T) {
+        // Seeded directly, so no invalidations are in flight
+        server.HSet("shop:session:def", userIDField, "bob")
+        server.SAdd("shop:session_user:bob", "abc", "def")
+        for _, sessionID := range []string{"abc", "def"} {
+            if _, err := remote.HGetAll(ctx, sessionID); err != nil {
+                t.Fatalf("HGetAll() error = %v", err)
+            }
+        }
+
+        invalidations := remote.Stats().Invalidations
+        if err := local.RevokeAllExcept(ctx, "bob", "abc"); err != nil {
+            t.Fatalf("RevokeAllExcept() error = %v", err)
+        }
+        waitFor("the invalidation", func() bool {
+            return remote.Stats().Invalidations > invalidations
+        })
+
+        // Exactly the revoked session is dropped, the kept one stays cached
+        if values, err := remote.HGetAll(ctx, "def"); err != nil || len(values) != 0 {
+            t.Errorf("revoked session = %v, %v; want it gone", values, err)
+        }
+        reads := server.Calls("HGETALL")
+        if _, err := remote.HGetAll(ctx, "abc"); err != nil || server.Calls("HGETALL") != reads {
+            t.Errorf("kept session was invalidated")
+        }
+        if got := remote.Stats().Invalidations - invalidations; got != 1 {
+            t.Errorf("invalidations = %d; want 1", got)
+        }
+    })
+
+    t.Run("Touch", func(t *testing.T) {
+        if _, err := remote.HGetAll(ctx, "abc"); err != nil {
+            t.Fatalf("HGetAll() error = %v", err)
+        }
+        publishes, reads := server.Calls("PUBLISH"), server.Calls("HGETALL")
+
+        // The last access written on every request keeps the session cached
+        remote.touched(ctx, "abc", map[string]string{lastAccessField: "42"})
+        if value, err := remote.HGet(ctx, "abc", lastAccessField); err != nil || value != "42" {
+            t.Errorf("HGet() after touch = %q, %v; want 42", value, err)
+        }
+        if server.Calls("HGETALL") != reads || server.Calls("PUBLISH") != publishes {
+            t.Errorf("touching the last access went to Redis")
+        }
+
+        // Any other field written by a touch invalidates it
+        remote.touched(ctx, "abc", map[string]string{lastAccessField: "43", "cart": "plum"})
+        if server.Calls("PUBLISH") == publishes {
+            t.Errorf("touching other fields was not published")
+        }
+        remote.mu.Lock()
+        _, ok := remote.entries[remote.key(ctx, "abc")]
+        remote.mu.Unlock()
+        if ok {
+            t.Errorf("touching other fields did not invalidate the session")
+        }
+    })
+}
@@ -0,0 +1,330 @@
+package sessionutils
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding"
+    "encoding/binary"
+    "encoding/gob"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "reflect"
+)
+
+// Codec turns session values into bytes and back. Every codec has a tag that
+// is stored with the values it writes, so values stay readable after the
+// configured codec changes. Tags below 16 are reserved for the built-in codecs.
+type Codec interface {
+    Tag() byte
+    Marshal(value any) ([]byte, error)
+    Unmarshal(data []byte, dest any) error
+}
+
+// Layout of a tagged value: valueMarker, codec tag, flags, payload.
+// Untagged values are plain JSON, which never starts with a NUL byte.
+const (
+    valueMarker     = 0x00
+    valueHeaderSize = 3
+    compressedFlag  = 0x01
+)
+
+// Tags of the built-in codecs, tags below reservedCodecTags are reserved
+const (
+    jsonCodecTag      = 1
+    gobCodecTag       = 2
+    binaryCodecTag    = 3
+    reservedCodecTags = 16
+)
+
+// compressionLevel favors speed, session values are read on every request
+const compressionLevel = flate.BestSpeed
+
+// JSONCodec encodes values with encoding/json. It is the default codec.
+type JSONCodec struct{}
+
+func (JSONCodec) Tag() byte                             { return jsonCodecTag }
+func (JSONCodec) Marshal(value any) ([]byte, error)     { return json.Marshal(value) }
+func (JSONCodec) Unmarshal(data []byte, dest any) error { return json.Unmarshal(data, dest) }
+
+// GobCodec encodes values with encoding/gob. It keeps the concrete types of
+// values stored in interfaces, which have to be registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Tag() byte { return gobCodecTag }
+
+func (GobCodec) Marshal(value any) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, dest any) error {
+    return gob.NewDecoder(bytes.NewReader(data)).Decode(dest)
+}
+
+// BinaryCodec is a compact codec for scalars, byte slices, fixed-size structs
+// and types implementing encoding.BinaryMarshaler, e.g. time.Time. Integers
+// are stored as varints, anything else it cannot encode is an error.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Tag() byte { return binaryCodecTag }
+
+func (BinaryCodec) Marshal(value any) ([]byte, error) {
+    if m, ok := value.(encoding.BinaryMarshaler); ok {
+        return m.MarshalBinary()
+    }
+
+    v := reflect.ValueOf(value)
+    switch v.Kind() {
+    case reflect.Bool:
+        if v.Bool() {
+            return []byte{1}, nil
+        }
+        return []byte{0}, nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return binary.AppendVarint(nil, v.Int()), nil
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return binary.AppendUvarint(nil, v.Uint()), nil
+    case reflect.Float32:
+        return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v.Float()))), nil
+    case reflect.Float64:
+        return binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())), nil
+    case reflect.String:
+        return []byte(v.String()), nil
+    case reflect.Slice:
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            return bytes.Clone(v.Bytes()), nil
+        }
+    }
+
+    var buf bytes.Buffer
+    if err := binary.Write(&buf, binary.BigEndian, value); err != nil {
+        return nil, fmt.Errorf("binary codec cannot encode %T: %w", value, err)
+    }
+    return buf.Bytes(), nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, dest any) error {
+    if u, ok := dest.(encoding.BinaryUnmarshaler); ok {
+        return u.UnmarshalBinary(data)
+    }
+
+    ptr := reflect.ValueOf(dest)
+    if ptr.Kind() != reflect.Pointer || ptr.IsNil() {
+        return fmt.Errorf("binary codec needs a non-nil pointer, got %T", dest)
+    }
+
+    v := ptr.Elem()
+    switch v.Kind() {
+    case reflect.Bool:
+        if len(data) != 1 {
+            return errors.New("binary codec: invalid bool")
+        }
+        v.SetBool(data[0] == 1)
+        return nil
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n, size := binary.Varint(data)
+        if size <= 0 || size != len(data) || v.OverflowInt(n) {
+            return fmt.Errorf("binary codec: invalid %s", v.Type())
+        }
+        v.SetInt(n)
+        return nil
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        n, size := binary.Uvarint(data)
+        if size <= 0 || size != len(data) || v.OverflowUint(n) {
+            return fmt.Errorf("binary codec: invalid %s", v.Type())
+        }
+        v.SetUint(n)
+        return nil
+    case reflect.Float32:
+        if len(data) != 4 {
+            return errors.New("binary codec: invalid float32")
+        }
+        v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(data))))
+        return nil
+    case reflect.Float64:
+        if len(data) != 8 {
+            return errors.New("binary codec: invalid float64")
+        }
+        v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+        return nil
+    case reflect.String:
+        v.SetString(string(data))
+        return nil
+    case reflect.Slice:
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            v.SetBytes(bytes.Clone(data))
+            return nil
+        }
+    }
+
+    if err := binary.Read(bytes.NewReader(data), binary.BigEndian, dest); err != nil {
+        return fmt.Errorf("binary codec cannot decode %T: %w", dest, err)
+    }
+    return nil
+}
+
+// checkCodec rejects a custom codec with a reserved tag, its values would be
+// read back with a built-in codec
+func checkCodec(codec Codec) error {
+    switch codec.(type) {
+    case nil, JSONCodec, *JSONCodec, GobCodec, *GobCodec, BinaryCodec, *BinaryCodec:
+        return nil
+    }
+    if codec.Tag() < reservedCodecTags {
+        return fmt.Errorf("codec %T uses tag %d, tags below %d are reserved", codec, codec.Tag(), reservedCodecTags)
+    }
+    return nil
+}
+
+// encodeValue encodes a session value with codec, compressing payloads larger
+// than compressAbove bytes if that makes them smaller. JSON values that are not
+// compressed are stored untagged, so they stay readable by older versions.
+func encodeValue(codec Codec, compressAbove int, value any) ([]byte, error) {
+    if err := checkCodec(codec); err != nil {
+        return nil, err
+    }
+    if codec == nil {
+        codec = JSONCodec{}
+    }
+
+    payload, err := codec.Marshal(value)
+    if err != nil {
+        return nil, err
+    }
+
+    var flags byte
+    if compressAbove > 0 && len(payload) > compressAbove {
+        compressed, err := compress(payload)
+        if err != nil {
+            return nil, err
+        }
+        if len(compressed) < len(payload) {
+            payload = compressed
+            flags |= compressedFlag
+        }
+    }
+
+    if codec.Tag() == jsonCodecTag && flags == 0 {
+        return payload, nil
+    }
+
+    data := make([]byte, 0, valueHeaderSize+len(payload))
+    data = append(data, valueMarker, codec.Tag(), flags)
+    return append(data, payload...), nil
+}
+
+// splitValue returns the codec tag and the decompressed payload of a session
+// value written by encodeValue. Untagged values are JSON.
+func splitValue(data []byte) (byte, []byte, error) {
+    if len(data) == 0 || data[0] != valueMarker {
+        return jsonCodecTag, data, nil
+    }
+    if len(data) < valueHeaderSize {
+        return 0, nil, errors.New("truncated session value")
+    }
+
+    tag, flags, payload := data[1], data[2], data[valueHeaderSize:]
+
+    if flags&compressedFlag != 0 {
+        decompressed, err := decompress(payload)
+        if err != nil {
+            return 0, nil, err
+        }
+        payload = decompressed
+    }
+
+    return tag, payload, nil
+}
+
+// valuePayload returns what the codec of a session value produced, e.g. the
+// JSON of a JSON value, without the header and decompressed
+func valuePayload(data []byte) ([]byte, error) {
+    _, payload, err := splitValue(data)
+    return payload, err
+}
+
+// decodeValue decodes a session value written by encodeValue, or an untagged
+// JSON value. Values of a custom codec can only be read if it is passed as codec.
+func decodeValue(codec Codec, data []byte, dest any) error {
+    if err := checkCodec(codec); err != nil {
+        return err
+    }
+
+    tag, payload, err := splitValue(data)
+    if err != nil {
+        return err
+    }
+
+    var valueCodec Codec
+    switch {
+    case codec != nil && codec.Tag() == tag:
+        valueCodec = codec
+    case tag == jsonCodecTag:
+        valueCodec = JSONCodec{}
+    case tag == gobCodecTag:
+        valueCodec = GobCodec{}
+    case tag == binaryCodecTag:
+        valueCodec = BinaryCodec{}
+    default:
+        return fmt.Errorf("unknown session value codec %d", tag)
+    }
+
+    return valueCodec.Unmarshal(payload, dest)
+}
+
+func compress(data []byte) ([]byte, error) {
+    var buf bytes.Buffer
+
+    w, err := flate.NewWriter(&buf, compressionLevel)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := w.Write(data); err != nil {
+        return nil, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+
+    return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+    r := flate.NewReader(bytes.NewReader(data))
+    defer r.Close()
+
+    decompressed, err := io.ReadAll(r)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decompress session value: %w", err)
+    }
+    return decompressed, nil
+}
+
+// codecStore is implemented by stores with a configurable codec, so the
+// package helpers that work on raw values encode them the same way
+type codecStore interface {
+    encodeValue(value any) ([]byte, error)
+    decodeValue(data []byte, dest any) error
+}
+
+// encodeFor encodes a value the way store saves it
+func encodeFor(store Store, value any) ([]byte, error) {
+    if cs, ok := store.(codecStore); ok {
+        return cs.encodeValue(value)
+    }
+    return json.Marshal(value)
+}
+
+// decodeFor decodes a raw value loaded from store
+func decodeFor(store Store, data []byte, dest any) error {
+    if cs, ok := store.(codecStore); ok {
+        return cs.decodeValue(data, dest)
+    }
+    return json.Unmarshal(data, dest)
+}
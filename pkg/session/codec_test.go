@@ -0,0 +1,142 @@
+package sessionutils
+
+import (
+    "bytes"
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+type testPoint struct {
+    X, Y int32
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+    codecs := []Codec{JSONCodec{}, GobCodec{}, BinaryCodec{}}
+
+    for _, codec := range codecs {
+        for _, compressAbove := range []int{0, 16} {
+            // A repetitive value large enough to be compressed
+            want := strings.Repeat("session ", 100)
+
+            data, err := encodeValue(codec, compressAbove, want)
+            if err != nil {
+                t.Fatalf("%T: encodeValue() error = %v", codec, err)
+            }
+            if compressAbove > 0 && len(data) >= len(want) {
+                t.Errorf("%T: value of %d bytes was not compressed", codec, len(data))
+            }
+
+            var got string
+            if err := decodeValue(nil, data, &got); err != nil {
+                t.Fatalf("%T: decodeValue() error = %v", codec, err)
+            }
+            if got != want {
+                t.Errorf("%T: decodeValue() = %q; want %q", codec, got, want)
+            }
+        }
+    }
+}
+
+func TestCodecUntaggedJSON(t *testing.T) {
+    // Plain JSON values stay untagged, and legacy values load with any codec
+    data, err := encodeValue(JSONCodec{}, 0, map[string]int{"a": 1})
+    if err != nil {
+        t.Fatalf("encodeValue() error = %v", err)
+    }
+    if string(data) != `{"a":1}` {
+        t.Errorf("encodeValue() = %q; want plain JSON", data)
+    }
+
+    var got map[string]int
+    if err := decodeValue(GobCodec{}, data, &got); err != nil || got["a"] != 1 {
+        t.Errorf("decodeValue() = %v, %v; want map[a:1], nil", got, err)
+    }
+
+    if err := decodeValue(nil, []byte{valueMarker, 200, 0, 'x'}, &got); err == nil {
+        t.Errorf("decodeValue() of an unknown codec returned no error")
+    }
+}
+
+func TestBinaryCodec(t *testing.T) {
+    now := time.Now().Round(0)
+    var gotTime time.Time
+    if data, err := encodeValue(BinaryCodec{}, 0, now); err != nil {
+        t.Fatalf("encodeValue(time) error = %v", err)
+    } else if err := decodeValue(nil, data, &gotTime); err != nil || !gotTime.Equal(now) {
+        t.Errorf("decodeValue(time) = %v, %v; want %v", gotTime, err, now)
+    }
+
+    // Large integers keep their precision, unlike with JSON numbers in interfaces
+    var gotInt int64
+    if data, err := encodeValue(BinaryCodec{}, 0, int64(1<<62+1)); err != nil {
+        t.Fatalf("encodeValue(int64) error = %v", err)
+    } else if err := decodeValue(nil, data, &gotInt); err != nil || gotInt != 1<<62+1 {
+        t.Errorf("decodeValue(int64) = %d, %v; want %d", gotInt, err, int64(1<<62+1))
+    }
+
+    var gotPoint testPoint
+    if data, err := encodeValue(BinaryCodec{}, 0, testPoint{X: 3, Y: -4}); err != nil {
+        t.Fatalf("encodeValue(struct) error = %v", err)
+    } else if err := decodeValue(nil, data, &gotPoint); err != nil || gotPoint != (testPoint{X: 3, Y: -4}) {
+        t.Errorf("decodeValue(struct) = %v, %v; want {3 -4}", gotPoint, err)
+    }
+
+    var gotBytes []byte
+    if data, err := encodeValue(BinaryCodec{}, 0, []byte{0, 1, 2}); err != nil {
+        t.Fatalf("encodeValue([]byte) error = %v", err)
+    } else if err := decodeValue(nil, data, &gotBytes); err != nil || !bytes.Equal(gotBytes, []byte{0, 1, 2}) {
+        t.Errorf("decodeValue([]byte) = %v, %v; want [0 1 2]", gotBytes, err)
+    }
+
+    if _, err := encodeValue(BinaryCodec{}, 0, map[string]int{}); err == nil {
+        t.Errorf("encodeValue(map) returned no error")
+    }
+}
+
+// reservedTagCodec is a custom codec claiming the tag of a built-in codec
+type reservedTagCodec struct{ JSONCodec }
+
+func (reservedTagCodec) Tag() byte { return gobCodecTag }
+
+func TestCodecReservedTag(t *testing.T) {
+    if _, err := encodeValue(reservedTagCodec{}, 0, "x"); err == nil {
+        t.Errorf("encodeValue() with a reserved tag returned no error")
+    }
+
+    data, err := encodeValue(GobCodec{}, 0, "x")
+    if err != nil {
+        t.Fatalf("encodeValue() error = %v", err)
+    }
+    var got string
+    if err := decodeValue(reservedTagCodec{}, data, &got); err == nil {
+        t.Errorf("decodeValue() with a reserved tag returned no error")
+    }
+}
+
+func TestValuePayload(t *testing.T) {
+    want := strings.Repeat("session ", 100)
+
+    data, err := encodeValue(JSONCodec{}, 16, want)
+    if err != nil {
+        t.Fatalf("encodeValue() error = %v", err)
+    }
+    if data[0] != valueMarker {
+        t.Fatalf("value was not compressed")
+    }
+
+    // Load returns what the codec produced, not the stored form
+    payload, err := valuePayload(data)
+    if err != nil {
+        t.Fatalf("valuePayload() error = %v", err)
+    }
+    encoded, _ := json.Marshal(want)
+    if !bytes.Equal(payload, encoded) {
+        t.Errorf("valuePayload() = %q; want the JSON of the value", payload)
+    }
+
+    if payload, err := valuePayload([]byte(`"plain"`)); err != nil || string(payload) != `"plain"` {
+        t.Errorf("valuePayload() of untagged JSON = %q, %v", payload, err)
+    }
+}
@@ -0,0 +1,94 @@
+package sessionutils_test
+
+import (
+    "context"
+    "os"
+    "testing"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/redis/go-redis/v9"
+    "github.com/valyala/fasthttp"
+
+    sessionutils "github.com/jsuto/go-kit/pkg/session"
+    "github.com/jsuto/go-kit/pkg/session/sessiontest"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+    sessiontest.RunStoreTests(t, func(t *testing.T) (sessionutils.Store, context.Context) {
+        store := sessionutils.NewMemoryStore(0)
+        t.Cleanup(store.Close)
+        return store, context.Background()
+    })
+}
+
+func TestCookieStoreConformance(t *testing.T) {
+    keyring, err := sessionutils.NewKeyring(make([]byte, 32))
+    if err != nil {
+        t.Fatalf("NewKeyring() error = %v", err)
+    }
+
+    app := fiber.New()
+
+    sessiontest.RunStoreTests(t, func(t *testing.T) (sessionutils.Store, context.Context) {
+        c := app.AcquireCtx(&fasthttp.RequestCtx{})
+        t.Cleanup(func() { app.ReleaseCtx(c) })
+
+        store := sessionutils.NewCookieStore(sessionutils.CookieStoreConfig{Keyring: keyring})
+        return store, sessionutils.WithFiberCtx(context.Background(), c)
+    })
+}
+
+func TestFileStoreConformance(t *testing.T) {
+    sessiontest.RunStoreTests(t, func(t *testing.T) (sessionutils.Store, context.Context) {
+        store, err := sessionutils.NewFileStore(sessionutils.FileStoreConfig{Dir: t.TempDir()})
+        if err != nil {
+            t.Fatalf("NewFileStore() error = %v", err)
+        }
+        t.Cleanup(store.Close)
+        return store, context.Background()
+    })
+}
+
+func TestMemoryStoreRememberConformance(t *testing.T) {
+    sessiontest.RunRememberStoreTests(t, func(t *testing.T) (sessionutils.RememberStore, context.Context) {
+        store := sessionutils.NewMemoryStore(0)
+        t.Cleanup(store.Close)
+        return store, context.Background()
+    })
+}
+
+// redisClient returns a client of the Redis server in REDIS_ADDR, skipping
+// the test without one. The server should be a scratch instance, the tests
+// leave their keys behind.
+func redisClient(t *testing.T) *redis.Client {
+    t.Helper()
+
+    addr := os.Getenv("REDIS_ADDR")
+    if addr == "" {
+        t.Skip("REDIS_ADDR is not set")
+    }
+
+    client := redis.NewClient(&redis.Options{Addr: addr})
+    t.Cleanup(func() { client.Close() })
+
+    if err := client.Ping(context.Background()).Err(); err != nil {
+        t.Fatalf("cannot reach Redis at %s: %v", addr, err)
+    }
+    return client
+}
+
+func TestSessionManagerConformance(t *testing.T) {
+    client := redisClient(t)
+
+    sessiontest.RunStoreTests(t, func(t *testing.T) (sessionutils.Store, context.Context) {
+        return sessionutils.NewSessionManager(client), context.Background()
+    })
+}
+
+func TestSessionManagerRememberConformance(t *testing.T) {
+    client := redisClient(t)
+
+    sessiontest.RunRememberStoreTests(t, func(t *testing.T) (sessionutils.RememberStore, context.Context) {
+        return sessionutils.NewSessionManager(client), context.Background()
+    })
+}
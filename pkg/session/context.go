@@ -0,0 +1,63 @@
+package sessionutils
+
+import (
+    "context"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+type contextKey int
+
+const (
+    fiberCtxKey contextKey = iota
+    tenantCtxKey
+    sessionIDCtxKey
+)
+
+// WithFiberCtx returns a copy of ctx carrying the Fiber context. Stores that
+// keep their state in the request or response (e.g. CookieStore) look it up
+// from the context passed to every Store call. Fiber recycles c once the
+// handler returned, so the returned context must not be used after that.
+func WithFiberCtx(ctx context.Context, c *fiber.Ctx) context.Context {
+    return context.WithValue(ctx, fiberCtxKey, c)
+}
+
+// FiberCtxFrom returns the Fiber context stored by WithFiberCtx
+func FiberCtxFrom(ctx context.Context) (*fiber.Ctx, bool) {
+    if ctx == nil {
+        return nil, false
+    }
+    c, ok := ctx.Value(fiberCtxKey).(*fiber.Ctx)
+    return c, ok && c != nil
+}
+
+// WithTenant returns a copy of ctx carrying the tenant. The session middleware
+// sets it for every request; code calling a store outside of a request, e.g.
+// to revoke the sessions of a user, has to set it itself.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+    return context.WithValue(ctx, tenantCtxKey, tenant)
+}
+
+// TenantFromContext returns the tenant stored by WithTenant, or "" if there is none
+func TenantFromContext(ctx context.Context) string {
+    if ctx == nil {
+        return ""
+    }
+    tenant, _ := ctx.Value(tenantCtxKey).(string)
+    return tenant
+}
+
+// WithSessionID returns a copy of ctx carrying the session ID, e.g. for
+// logging or tracing in Redis hooks
+func WithSessionID(ctx context.Context, sessionID string) context.Context {
+    return context.WithValue(ctx, sessionIDCtxKey, sessionID)
+}
+
+// SessionIDFromContext returns the session ID stored by WithSessionID, or "" if there is none
+func SessionIDFromContext(ctx context.Context) string {
+    if ctx == nil {
+        return ""
+    }
+    sessionID, _ := ctx.Value(sessionIDCtxKey).(string)
+    return sessionID
+}
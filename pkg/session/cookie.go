@@ -0,0 +1,107 @@
+package sessionutils
+
+import (
+    "errors"
+    "strings"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/valyala/fasthttp"
+)
+
+// Cookie name prefixes that browsers only accept with certain attributes
+const (
+    hostCookiePrefix   = "__Host-"   // Secure, Path=/ and no Domain
+    secureCookiePrefix = "__Secure-" // Secure
+)
+
+// validateCookie rejects cookie settings that contradict the cookie name prefix
+func (config SessionMiddlewareConfig) validateCookie() error {
+    if strings.HasPrefix(config.CookieName, hostCookiePrefix) {
+        if config.CookieDomain != "" {
+            return errors.New("a __Host- cookie must not have a Domain")
+        }
+        if config.CookiePath != "" && config.CookiePath != "/" {
+            return errors.New("a __Host- cookie must have Path=/")
+        }
+    }
+    return nil
+}
+
+// newCookie is the single factory for the session cookie. Every code path
+// setting or expiring it builds the cookie here, so the attributes match.
+func (config SessionMiddlewareConfig) newCookie(value string) *fiber.Cookie {
+    cookie := &fiber.Cookie{
+        Name:     config.CookieName,
+        Value:    value,
+        HTTPOnly: true,
+        Secure:   config.Secure,
+        SameSite: config.CookieSameSite,
+        Domain:   config.CookieDomain,
+        Path:     config.CookiePath,
+    }
+
+    if cookie.SameSite == "" {
+        cookie.SameSite = fiber.CookieSameSiteLaxMode
+    }
+    if cookie.Path == "" {
+        cookie.Path = "/"
+    }
+
+    // Browsers drop SameSite=None and partitioned cookies without Secure
+    if strings.EqualFold(cookie.SameSite, fiber.CookieSameSiteNoneMode) || config.CookiePartitioned {
+        cookie.Secure = true
+    }
+
+    switch {
+    case strings.HasPrefix(cookie.Name, hostCookiePrefix):
+        cookie.Secure = true
+        cookie.Path = "/"
+        cookie.Domain = ""
+    case strings.HasPrefix(cookie.Name, secureCookiePrefix):
+        cookie.Secure = true
+    }
+
+    return cookie
+}
+
+// setSessionCookie sets the session cookie to value
+func setSessionCookie(c *fiber.Ctx, config SessionMiddlewareConfig, value string) {
+    cookie := config.newCookie(value)
+    if config.CookieSessionOnly {
+        cookie.SessionOnly = true
+    } else {
+        cookie.Expires = time.Now().Add(config.SessionDuration)
+    }
+
+    writeCookie(c, cookie, config.CookiePartitioned)
+}
+
+// expireSessionCookie tells the client to drop the session cookie
+func expireSessionCookie(c *fiber.Ctx, config SessionMiddlewareConfig) {
+    cookie := config.newCookie("")
+    cookie.Expires = time.Unix(0, 0)
+
+    writeCookie(c, cookie, config.CookiePartitioned)
+}
+
+// writeCookie sets a response cookie. Fiber has no Partitioned attribute yet,
+// so for partitioned cookies it is appended to the serialized cookie.
+func writeCookie(c *fiber.Ctx, cookie *fiber.Cookie, partitioned bool) {
+    c.Cookie(cookie)
+    if !partitioned {
+        return
+    }
+
+    fcookie := fasthttp.AcquireCookie()
+    defer fasthttp.ReleaseCookie(fcookie)
+
+    fcookie.SetKey(cookie.Name)
+    if !c.Response().Header.Cookie(fcookie) {
+        return
+    }
+
+    raw := string(fcookie.Cookie()) + "; Partitioned"
+    c.Response().Header.DelCookie(cookie.Name)
+    c.Response().Header.Add(fiber.HeaderSetCookie, raw)
+}
@@ -0,0 +1,77 @@
+package sessionutils
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestSessionCookieAttributes(t *testing.T) {
+    tests := []struct {
+        name    string
+        config  SessionMiddlewareConfig
+        want    []string
+        notWant []string
+    }{
+        {
+            name:    "Defaults",
+            config:  SessionMiddlewareConfig{CookieName: "sid"},
+            want:    []string{"path=/", "HttpOnly", "SameSite=Lax", "expires="},
+            notWant: []string{"secure", "domain=", "Partitioned"},
+        },
+        {
+            name:   "CrossSiteIframe",
+            config: SessionMiddlewareConfig{CookieName: "sid", CookieSameSite: "None", CookiePartitioned: true, CookieDomain: "example.com"},
+            want:   []string{"SameSite=None", "secure", "Partitioned", "domain=example.com"},
+        },
+        {
+            name:    "HostPrefix",
+            config:  SessionMiddlewareConfig{CookieName: "__Host-sid", CookieSessionOnly: true},
+            want:    []string{"secure", "path=/"},
+            notWant: []string{"domain=", "expires="},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store := NewMemoryStore(0)
+            defer store.Close()
+
+            tt.config.Store = store
+            tt.config.SessionDuration = time.Hour
+            tt.config.RegenerateAfter = time.Hour
+
+            app := fiber.New()
+            app.Use(NewSessionMiddleware(tt.config))
+            app.Get("/", func(c *fiber.Ctx) error {
+                return nil
+            })
+
+            resp, _ := doRequest(t, app, "GET", "/", nil)
+            header := resp.Header.Get(fiber.HeaderSetCookie)
+
+            for _, attr := range tt.want {
+                if !strings.Contains(header, attr) {
+                    t.Errorf("Set-Cookie %q lacks %q", header, attr)
+                }
+            }
+            for _, attr := range tt.notWant {
+                if strings.Contains(header, attr) {
+                    t.Errorf("Set-Cookie %q has %q", header, attr)
+                }
+            }
+        })
+    }
+}
+
+func TestHostCookiePrefixValidation(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Errorf("NewSessionMiddleware() accepted a __Host- cookie with a Domain")
+        }
+    }()
+
+    NewSessionMiddleware(SessionMiddlewareConfig{CookieName: "__Host-sid", CookieDomain: "example.com"})
+}
@@ -0,0 +1,462 @@
+package sessionutils
+
+import (
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+var (
+    // ErrNoRequestContext is returned by CookieStore when the context passed
+    // to a Store call does not carry a Fiber context (see WithFiberCtx)
+    ErrNoRequestContext = errors.New("no fiber context in request context")
+
+    // ErrCookieTooLarge is returned when the encrypted session no longer
+    // fits into a single cookie
+    ErrCookieTooLarge = errors.New("session data exceeds cookie size limit")
+
+    errInvalidCookie = errors.New("invalid session cookie")
+)
+
+// DefaultMaxCookieSize is the default limit for the encoded cookie value.
+// Browsers commonly cap a cookie (name, value and attributes) at 4096 bytes.
+const DefaultMaxCookieSize = 3800
+
+// Keyring holds the AES-GCM keys used to encrypt session cookies. The first
+// key encrypts new cookies, every key is tried when decrypting, so keys can
+// be rotated by prepending a new one and dropping the oldest later.
+type Keyring struct {
+    aeads []cipher.AEAD
+}
+
+// NewKeyring creates a keyring from one or more AES keys (16, 24 or 32 bytes)
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+    if len(keys) == 0 {
+        return nil, errors.New("keyring needs at least one key")
+    }
+
+    kr := &Keyring{}
+    for i, key := range keys {
+        block, err := aes.NewCipher(key)
+        if err != nil {
+            return nil, fmt.Errorf("invalid key #%d: %w", i, err)
+        }
+        aead, err := cipher.NewGCM(block)
+        if err != nil {
+            return nil, fmt.Errorf("invalid key #%d: %w", i, err)
+        }
+        kr.aeads = append(kr.aeads, aead)
+    }
+
+    return kr, nil
+}
+
+// seal encrypts plaintext with the primary key; the nonce is prepended
+func (kr *Keyring) seal(plaintext, additionalData []byte) ([]byte, error) {
+    aead := kr.aeads[0]
+
+    nonce := make([]byte, aead.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+
+    return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts ciphertext with the first key that authenticates it
+func (kr *Keyring) open(ciphertext, additionalData []byte) ([]byte, error) {
+    for _, aead := range kr.aeads {
+        if len(ciphertext) < aead.NonceSize() {
+            continue
+        }
+        nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+        if plaintext, err := aead.Open(nil, nonce, sealed, additionalData); err == nil {
+            return plaintext, nil
+        }
+    }
+    return nil, errInvalidCookie
+}
+
+// CookieStoreConfig defines the config for CookieStore
+type CookieStoreConfig struct {
+    Keyring    *Keyring
+    CookieName string // defaults to "session_data"
+    Secure     bool
+    MaxSize    int // maximum encoded cookie value length, defaults to DefaultMaxCookieSize
+}
+
+// cookiePayload is the plaintext sealed into the cookie
+type cookiePayload struct {
+    ID        string            `json:"id"`
+    ExpiresAt int64             `json:"exp,omitempty"` // unix milliseconds, 0 means no expiry
+    Values    map[string]string `json:"v"`
+}
+
+func (p *cookiePayload) expired(now time.Time) bool {
+    return p.ExpiresAt != 0 && now.UnixMilli() >= p.ExpiresAt
+}
+
+func (p *cookiePayload) clone() *cookiePayload {
+    cp := &cookiePayload{ID: p.ID, ExpiresAt: p.ExpiresAt, Values: make(map[string]string, len(p.Values))}
+    for k, v := range p.Values {
+        cp.Values[k] = v
+    }
+    return cp
+}
+
+// CookieStore is a stateless Store that keeps the whole session inside an
+// encrypted and authenticated (AES-GCM) cookie. The expiry is sealed into
+// the ciphertext, so a client cannot extend it.
+//
+// A cookie holds a single session. CookieStore needs the Fiber context of the
+// current request, which NewSessionMiddleware and the package helpers attach
+// to the contexts they use; handlers calling it directly pass
+// WithFiberCtx(c.UserContext(), c).
+type CookieStore struct {
+    config CookieStoreConfig
+}
+
+// NewCookieStore creates a new cookie-backed store
+func NewCookieStore(config CookieStoreConfig) *CookieStore {
+    if config.Keyring == nil {
+        panic("sessionutils: CookieStore requires a Keyring")
+    }
+    if config.CookieName == "" {
+        config.CookieName = "session_data"
+    }
+    if config.MaxSize <= 0 {
+        config.MaxSize = DefaultMaxCookieSize
+    }
+
+    return &CookieStore{config: config}
+}
+
+func (cs *CookieStore) localsKey() string {
+    return "session_cookie_store:" + cs.config.CookieName
+}
+
+// state returns the decoded payload of the current request. The cookie is
+// decoded once and then kept in Fiber locals for the rest of the request.
+func (cs *CookieStore) state(ctx context.Context) (*fiber.Ctx, *cookiePayload, error) {
+    c, ok := FiberCtxFrom(ctx)
+    if !ok {
+        return nil, nil, ErrNoRequestContext
+    }
+
+    if payload, ok := c.Locals(cs.localsKey()).(*cookiePayload); ok {
+        return c, payload, nil
+    }
+
+    payload, err := cs.decode(c.Cookies(cs.config.CookieName))
+    if err != nil {
+        // A missing, tampered or expired cookie is an empty session
+        payload = &cookiePayload{Values: make(map[string]string)}
+    }
+    c.Locals(cs.localsKey(), payload)
+
+    return c, payload, nil
+}
+
+// session returns the live payload for sessionID, or nil
+func (cs *CookieStore) session(ctx context.Context, sessionID string) (*cookiePayload, error) {
+    _, payload, err := cs.state(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if payload.ID != sessionID || payload.expired(time.Now()) || len(payload.Values) == 0 {
+        return nil, nil
+    }
+    return payload, nil
+}
+
+// update applies fn to the payload of sessionID and writes the new cookie.
+// If the result does not fit into the cookie, the previous state is kept.
+func (cs *CookieStore) update(ctx context.Context, sessionID string, create bool, fn func(p *cookiePayload)) error {
+    c, current, err := cs.state(ctx)
+    if err != nil {
+        return err
+    }
+
+    var next *cookiePayload
+    if current.ID == sessionID && !current.expired(time.Now()) && len(current.Values) > 0 {
+        next = current.clone()
+    } else if create {
+        // The cookie only ever holds one session, so writing to another
+        // session ID replaces it
+        next = &cookiePayload{ID: sessionID, Values: make(map[string]string)}
+    } else {
+        return nil
+    }
+
+    fn(next)
+
+    return cs.write(c, next)
+}
+
+// write stores the payload in the response cookie and in the request state,
+// an empty payload expires the cookie
+func (cs *CookieStore) write(c *fiber.Ctx, next *cookiePayload) error {
+    if len(next.Values) == 0 {
+        cs.expireCookie(c)
+        c.Locals(cs.localsKey(), &cookiePayload{Values: make(map[string]string)})
+        return nil
+    }
+
+    value, err := cs.encode(next)
+    if err != nil {
+        return err
+    }
+
+    cookie := &fiber.Cookie{
+        Name:     cs.config.CookieName,
+        Value:    value,
+        HTTPOnly: true,
+        Secure:   cs.config.Secure,
+        SameSite: "Lax",
+        Path:     "/",
+    }
+    if next.ExpiresAt != 0 {
+        cookie.Expires = time.UnixMilli(next.ExpiresAt)
+    } else {
+        cookie.SessionOnly = true
+    }
+    c.Cookie(cookie)
+    c.Locals(cs.localsKey(), next)
+
+    return nil
+}
+
+func (cs *CookieStore) expireCookie(c *fiber.Ctx) {
+    c.Cookie(&fiber.Cookie{
+        Name:     cs.config.CookieName,
+        Value:    "",
+        HTTPOnly: true,
+        Secure:   cs.config.Secure,
+        SameSite: "Lax",
+        Path:     "/",
+        Expires:  time.Unix(0, 0),
+    })
+}
+
+// encode seals the payload into a cookie value
+func (cs *CookieStore) encode(payload *cookiePayload) (string, error) {
+    plaintext, err := json.Marshal(payload)
+    if err != nil {
+        return "", fmt.Errorf("failed to marshal session cookie: %w", err)
+    }
+
+    sealed, err := cs.config.Keyring.seal(plaintext, []byte(cs.config.CookieName))
+    if err != nil {
+        return "", fmt.Errorf("failed to encrypt session cookie: %w", err)
+    }
+
+    value := base64.RawURLEncoding.EncodeToString(sealed)
+    if len(value) > cs.config.MaxSize {
+        return "", fmt.Errorf("%w: %d bytes, limit is %d", ErrCookieTooLarge, len(value), cs.config.MaxSize)
+    }
+
+    return value, nil
+}
+
+// decode opens a cookie value and rejects expired payloads
+func (cs *CookieStore) decode(value string) (*cookiePayload, error) {
+    if value == "" || len(value) > cs.config.MaxSize {
+        return nil, errInvalidCookie
+    }
+
+    sealed, err := base64.RawURLEncoding.DecodeString(value)
+    if err != nil {
+        return nil, errInvalidCookie
+    }
+
+    plaintext, err := cs.config.Keyring.open(sealed, []byte(cs.config.CookieName))
+    if err != nil {
+        return nil, err
+    }
+
+    var payload cookiePayload
+    if err := json.Unmarshal(plaintext, &payload); err != nil {
+        return nil, errInvalidCookie
+    }
+    if payload.expired(time.Now()) {
+        return nil, errInvalidCookie
+    }
+    if payload.Values == nil {
+        payload.Values = make(map[string]string)
+    }
+
+    return &payload, nil
+}
+
+// Save saves a Go value into the session
+func (cs *CookieStore) Save(ctx context.Context, sessionID, key string, value any) error {
+    jsonValue, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Errorf("failed to marshal session value: %w", err)
+    }
+
+    if err := cs.update(ctx, sessionID, true, func(p *cookiePayload) {
+        p.Values[key] = string(jsonValue)
+    }); err != nil {
+        return fmt.Errorf("failed to save session data: %w", err)
+    }
+
+    return nil
+}
+
+// Load loads a raw value (as []byte) from the session
+func (cs *CookieStore) Load(ctx context.Context, sessionID, key string) ([]byte, error) {
+    payload, err := cs.session(ctx, sessionID)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load session data: %w", err)
+    }
+    if payload == nil {
+        return nil, &notFoundError{key: key}
+    }
+
+    data, ok := payload.Values[key]
+    if !ok {
+        return nil, &notFoundError{key: key}
+    }
+
+    return []byte(data), nil
+}
+
+// LoadJSON unmarshals a Go value from the session
+func (cs *CookieStore) LoadJSON(ctx context.Context, sessionID, key string, dest any) error {
+    raw, err := cs.Load(ctx, sessionID, key)
+    if err != nil {
+        return err
+    }
+
+    if err := json.Unmarshal(raw, dest); err != nil {
+        return fmt.Errorf("failed to unmarshal session value: %w", err)
+    }
+
+    return nil
+}
+
+// Delete deletes a key from the session
+func (cs *CookieStore) Delete(ctx context.Context, sessionID, key string) error {
+    if err := cs.update(ctx, sessionID, false, func(p *cookiePayload) {
+        delete(p.Values, key)
+    }); err != nil {
+        return fmt.Errorf("failed to delete session key %q: %w", key, err)
+    }
+
+    return nil
+}
+
+// Clear deletes the entire session
+func (cs *CookieStore) Clear(ctx context.Context, sessionID string) error {
+    if err := cs.update(ctx, sessionID, false, func(p *cookiePayload) {
+        p.Values = map[string]string{}
+    }); err != nil {
+        return fmt.Errorf("failed to clear session: %w", err)
+    }
+
+    return nil
+}
+
+// HSet sets multiple fields in the session
+func (cs *CookieStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    if len(values) == 0 {
+        return nil
+    }
+
+    return cs.update(ctx, sessionID, true, func(p *cookiePayload) {
+        for k, v := range values {
+            p.Values[k] = v
+        }
+    })
+}
+
+// HGetAll gets all fields from the session
+func (cs *CookieStore) HGetAll(ctx context.Context, sessionID string) (map[string]string, error) {
+    payload, err := cs.session(ctx, sessionID)
+    if err != nil {
+        return nil, err
+    }
+
+    result := make(map[string]string)
+    if payload != nil {
+        for k, v := range payload.Values {
+            result[k] = v
+        }
+    }
+
+    return result, nil
+}
+
+// HGet gets a single field from the session
+func (cs *CookieStore) HGet(ctx context.Context, sessionID, key string) (string, error) {
+    payload, err := cs.session(ctx, sessionID)
+    if err != nil {
+        return "", err
+    }
+    if payload == nil {
+        return "", &notFoundError{key: key}
+    }
+
+    value, ok := payload.Values[key]
+    if !ok {
+        return "", &notFoundError{key: key}
+    }
+
+    return value, nil
+}
+
+// Expire sets an expiration time for the session. The expiry is sealed into
+// the cookie and also used as the cookie's own Expires attribute.
+func (cs *CookieStore) Expire(ctx context.Context, sessionID string, expiration time.Duration) error {
+    return cs.update(ctx, sessionID, false, func(p *cookiePayload) {
+        if expiration <= 0 {
+            p.Values = map[string]string{}
+            return
+        }
+        p.ExpiresAt = time.Now().Add(expiration).UnixMilli()
+    })
+}
+
+// RotateSession moves the session to a new ID. A cookie holds a single
+// session, so the old ID is dropped at once and Grace is ignored: an alias
+// would replace the session it points to.
+func (cs *CookieStore) RotateSession(ctx context.Context, oldSessionID, newSessionID string, opts RotateOptions) (string, error) {
+    c, _, err := cs.state(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    next := &cookiePayload{ID: newSessionID, Values: make(map[string]string)}
+    if opts.KeepData {
+        current, err := cs.session(ctx, oldSessionID)
+        if err != nil {
+            return "", err
+        }
+        if current != nil {
+            for k, v := range current.Values {
+                next.Values[k] = v
+            }
+        }
+    }
+    for k, v := range opts.Fields {
+        next.Values[k] = v
+    }
+    if opts.TTL > 0 {
+        next.ExpiresAt = time.Now().Add(opts.TTL).UnixMilli()
+    }
+
+    if err := cs.write(c, next); err != nil {
+        return "", fmt.Errorf("failed to rotate session: %w", err)
+    }
+
+    return newSessionID, nil
+}
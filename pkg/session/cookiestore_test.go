@@ -0,0 +1,135 @@
+package sessionutils
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func newCookieStoreApp(t *testing.T, store *CookieStore) *fiber.App {
+    t.Helper()
+    return newCookieStoreAppRotating(t, store, time.Hour)
+}
+
+func newCookieStoreAppRotating(t *testing.T, store *CookieStore, regenerateAfter time.Duration) *fiber.App {
+    t.Helper()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: regenerateAfter,
+    }))
+    app.Post("/", func(c *fiber.Ctx) error {
+        return store.Save(WithFiberCtx(c.UserContext(), c), MustGetSessionID(c), "value", c.Query("v"))
+    })
+    app.Get("/", func(c *fiber.Ctx) error {
+        var value string
+        if err := store.LoadJSON(WithFiberCtx(c.UserContext(), c), MustGetSessionID(c), "value", &value); err != nil {
+            return c.SendString("none")
+        }
+        return c.SendString(value)
+    })
+
+    return app
+}
+
+func doRequest(t *testing.T, app *fiber.App, method, target string, cookies []*http.Cookie) (*http.Response, string) {
+    t.Helper()
+
+    req := httptest.NewRequest(method, target, nil)
+    for _, cookie := range cookies {
+        req.AddCookie(cookie)
+    }
+
+    resp, err := app.Test(req)
+    if err != nil {
+        t.Fatalf("app.Test() error = %v", err)
+    }
+
+    var body strings.Builder
+    buf := make([]byte, 512)
+    for {
+        n, err := resp.Body.Read(buf)
+        body.Write(buf[:n])
+        if err != nil {
+            break
+        }
+    }
+
+    return resp, body.String()
+}
+
+func TestCookieStoreRoundTripAndKeyRotation(t *testing.T) {
+    oldKey := []byte(strings.Repeat("o", 32))
+    newKey := []byte(strings.Repeat("n", 32))
+
+    oldRing, _ := NewKeyring(oldKey)
+    resp, _ := doRequest(t, newCookieStoreApp(t, NewCookieStore(CookieStoreConfig{Keyring: oldRing})), "POST", "/?v=hello", nil)
+    cookies := resp.Cookies()
+
+    // The new primary key must still read cookies sealed with the old one
+    rotated, _ := NewKeyring(newKey, oldKey)
+    if _, body := doRequest(t, newCookieStoreApp(t, NewCookieStore(CookieStoreConfig{Keyring: rotated})), "GET", "/", cookies); body != "hello" {
+        t.Errorf("body with rotated keyring = %q; want %q", body, "hello")
+    }
+
+    // Once the old key is dropped the cookie is no longer accepted
+    dropped, _ := NewKeyring(newKey)
+    if _, body := doRequest(t, newCookieStoreApp(t, NewCookieStore(CookieStoreConfig{Keyring: dropped})), "GET", "/", cookies); body != "none" {
+        t.Errorf("body after dropping old key = %q; want %q", body, "none")
+    }
+}
+
+func TestCookieStoreTooLarge(t *testing.T) {
+    keyring, _ := NewKeyring(make([]byte, 16))
+    store := NewCookieStore(CookieStoreConfig{Keyring: keyring, MaxSize: 256})
+
+    app := fiber.New()
+    app.Get("/", func(c *fiber.Ctx) error {
+        ctx := WithFiberCtx(c.UserContext(), c)
+        if err := store.Save(ctx, "abc", "small", "x"); err != nil {
+            t.Errorf("Save() of small value error = %v", err)
+        }
+        if err := store.Save(ctx, "abc", "big", strings.Repeat("x", 512)); !errors.Is(err, ErrCookieTooLarge) {
+            t.Errorf("Save() of big value error = %v; want ErrCookieTooLarge", err)
+        }
+        // The failed write must not discard what was already there
+        if _, err := store.Load(ctx, "abc", "small"); err != nil {
+            t.Errorf("Load() after failed Save() error = %v", err)
+        }
+        return nil
+    })
+
+    doRequest(t, app, "GET", "/", nil)
+}
+
+func TestCookieStoreRotation(t *testing.T) {
+    keyring, _ := NewKeyring(make([]byte, 32))
+
+    // The session is due for rotation on every request
+    app := newCookieStoreAppRotating(t, NewCookieStore(CookieStoreConfig{Keyring: keyring}), time.Nanosecond)
+
+    resp, _ := doRequest(t, app, "POST", "/?v=kept", nil)
+    cookies := resp.Cookies()
+    original := sessionCookie(resp, "sid")
+
+    for i := 0; i < 2; i++ {
+        resp, body := doRequest(t, app, "GET", "/", cookies)
+        if body != "kept" {
+            t.Fatalf("value after rotation #%d = %q; want %q", i+1, body, "kept")
+        }
+        rotated := sessionCookie(resp, "sid")
+        if rotated == nil || rotated.Value == original.Value {
+            t.Fatalf("session ID was not rotated")
+        }
+        original = rotated
+        cookies = resp.Cookies()
+    }
+}
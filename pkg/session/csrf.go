@@ -0,0 +1,266 @@
+package sessionutils
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+const (
+    // csrfTokenField holds the synchronizer token in the session
+    csrfTokenField = "csrf_token"
+
+    // csrfPreviousField holds the token replaced by a rotation during the
+    // grace period, as "<unix ms until which it is accepted>:<token>"
+    csrfPreviousField = "csrf_previous"
+
+    csrfConfigKey        = "csrf_config"
+    csrfTokenKey         = "csrf_token"
+    csrfPreviousTokenKey = "csrf_previous_token"
+)
+
+// CSRFConfig defines the config for the CSRF middleware
+type CSRFConfig struct {
+    HeaderName string // request header carrying the token, defaults to "X-CSRF-Token"
+    FormField  string // form field carrying the token, defaults to "_csrf"
+
+    // DoubleSubmit switches to the stateless double-submit cookie variant:
+    // the token lives in a cookie readable by scripts instead of the session
+    DoubleSubmit bool
+    CookieName   string // double-submit cookie name, defaults to "csrf_token"
+    Secure       bool   // Secure attribute of the double-submit cookie
+
+    // ErrorHandler is called when the token is missing or wrong.
+    // Defaults to returning fiber.ErrForbidden.
+    ErrorHandler fiber.Handler
+}
+
+// NewCSRFMiddleware returns a Fiber middleware that rejects unsafe requests
+// (POST, PUT, PATCH, DELETE) without a valid CSRF token. In the default mode
+// the token is a synchronizer token kept in the session, so the middleware
+// must run after NewSessionMiddleware. Use CSRFToken to render the token.
+func NewCSRFMiddleware(config CSRFConfig) fiber.Handler {
+    if config.HeaderName == "" {
+        config.HeaderName = "X-CSRF-Token"
+    }
+    if config.FormField == "" {
+        config.FormField = "_csrf"
+    }
+    if config.CookieName == "" {
+        config.CookieName = "csrf_token"
+    }
+    if config.ErrorHandler == nil {
+        config.ErrorHandler = func(c *fiber.Ctx) error {
+            return fiber.ErrForbidden
+        }
+    }
+
+    return func(c *fiber.Ctx) error {
+        c.Locals(csrfConfigKey, &config)
+
+        switch c.Method() {
+        case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions, fiber.MethodTrace:
+            return c.Next()
+        }
+
+        submitted := c.Get(config.HeaderName)
+        if submitted == "" {
+            submitted = c.FormValue(config.FormField)
+        }
+        if submitted == "" {
+            return config.ErrorHandler(c)
+        }
+
+        var expected []string
+        if config.DoubleSubmit {
+            expected = append(expected, c.Cookies(config.CookieName))
+        } else {
+            token, err := loadCSRFToken(c)
+            if err != nil && !errors.Is(err, ErrKeyNotFound) {
+                return fiber.ErrInternalServerError
+            }
+            expected = append(expected, token)
+
+            // The token of the previous session ID stays valid for the
+            // request during which the session was rotated
+            if previous, ok := c.Locals(csrfPreviousTokenKey).(string); ok {
+                expected = append(expected, previous)
+            }
+        }
+
+        for _, token := range expected {
+            if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) == 1 {
+                return c.Next()
+            }
+        }
+
+        // Concurrent requests sent with the old session ID carry the token
+        // replaced by the rotation, it stays valid for the grace period
+        if !config.DoubleSubmit {
+            if previous := previousCSRFToken(c); previous != "" && subtle.ConstantTimeCompare([]byte(previous), []byte(submitted)) == 1 {
+                return c.Next()
+            }
+        }
+
+        return config.ErrorHandler(c)
+    }
+}
+
+// CSRFToken returns the CSRF token to embed into forms or send in the
+// X-CSRF-Token header, creating it on first use
+func CSRFToken(c *fiber.Ctx) (string, error) {
+    if token, ok := c.Locals(csrfTokenKey).(string); ok && token != "" {
+        return token, nil
+    }
+
+    config, ok := c.Locals(csrfConfigKey).(*CSRFConfig)
+    if !ok || config == nil {
+        return "", fiber.NewError(fiber.StatusInternalServerError, "CSRF middleware is not configured")
+    }
+
+    if config.DoubleSubmit {
+        token := c.Cookies(config.CookieName)
+        if token == "" {
+            newToken, err := generateCSRFToken()
+            if err != nil {
+                return "", err
+            }
+            token = newToken
+
+            c.Cookie(&fiber.Cookie{
+                Name:        config.CookieName,
+                Value:       token,
+                HTTPOnly:    false, // read by scripts to fill the header
+                Secure:      config.Secure,
+                SameSite:    "Lax",
+                Path:        "/",
+                SessionOnly: true,
+            })
+        }
+        c.Locals(csrfTokenKey, token)
+        return token, nil
+    }
+
+    token, err := loadCSRFToken(c)
+    if err == nil {
+        return token, nil
+    }
+    if !errors.Is(err, ErrKeyNotFound) {
+        return "", err
+    }
+
+    token, err = generateCSRFToken()
+    if err != nil {
+        return "", err
+    }
+
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return "", err
+    }
+    if err := store.HSet(ctx, sessionID, map[string]string{csrfTokenField: token}); err != nil {
+        return "", err
+    }
+    c.Locals(csrfTokenKey, token)
+
+    return token, nil
+}
+
+// loadCSRFToken reads the synchronizer token from the session
+func loadCSRFToken(c *fiber.Ctx) (string, error) {
+    if token, ok := c.Locals(csrfTokenKey).(string); ok && token != "" {
+        return token, nil
+    }
+
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return "", err
+    }
+
+    token, err := store.HGet(ctx, sessionID, csrfTokenField)
+    if err != nil {
+        return "", err
+    }
+    c.Locals(csrfTokenKey, token)
+
+    return token, nil
+}
+
+// previousCSRFToken returns the token replaced by the last rotation of the
+// session, if its grace period has not ended
+func previousCSRFToken(c *fiber.Ctx) string {
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return ""
+    }
+
+    value, err := store.HGet(ctx, sessionID, csrfPreviousField)
+    if err != nil {
+        return ""
+    }
+
+    until, token, ok := strings.Cut(value, ":")
+    if !ok {
+        return ""
+    }
+    if ms, err := strconv.ParseInt(until, 10, 64); err != nil || time.Now().UnixMilli() >= ms {
+        return ""
+    }
+
+    return token
+}
+
+// rotateCSRFToken replaces the CSRF token of a freshly rotated session, if it
+// has one. The old token is kept in locals, so the current request still
+// passes, and for grace in the session, for concurrent requests still
+// carrying the old session ID.
+func rotateCSRFToken(ctx context.Context, c *fiber.Ctx, store Store, sessionID string, grace time.Duration) error {
+    previous, err := store.HGet(ctx, sessionID, csrfTokenField)
+    if errors.Is(err, ErrKeyNotFound) {
+        // Forget a token cached for the old session
+        c.Locals(csrfTokenKey, nil)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    token, err := generateCSRFToken()
+    if err != nil {
+        return err
+    }
+    if grace > 0 {
+        until := strconv.FormatInt(time.Now().Add(grace).UnixMilli(), 10)
+        err = store.HSet(ctx, sessionID, map[string]string{csrfTokenField: token, csrfPreviousField: until + ":" + previous})
+    } else {
+        // A token from before an earlier rotation must not outlive this one
+        err = store.HSet(ctx, sessionID, map[string]string{csrfTokenField: token})
+        if err == nil {
+            err = store.Delete(ctx, sessionID, csrfPreviousField)
+        }
+    }
+    if err != nil {
+        return err
+    }
+
+    c.Locals(csrfPreviousTokenKey, previous)
+    c.Locals(csrfTokenKey, token)
+
+    return nil
+}
+
+// generateCSRFToken creates a new random token
+func generateCSRFToken() (string, error) {
+    bytes := make([]byte, 32)
+    if _, err := rand.Read(bytes); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
@@ -0,0 +1,139 @@
+package sessionutils
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Use(NewCSRFMiddleware(CSRFConfig{}))
+    app.Get("/form", func(c *fiber.Ctx) error {
+        token, err := CSRFToken(c)
+        if err != nil {
+            return err
+        }
+        return c.SendString(token)
+    })
+    app.Post("/submit", func(c *fiber.Ctx) error {
+        return c.SendString("ok")
+    })
+    app.Post("/login", func(c *fiber.Ctx) error {
+        if _, err := Regenerate(c, true); err != nil {
+            return err
+        }
+        token, err := CSRFToken(c)
+        if err != nil {
+            return err
+        }
+        return c.SendString(token)
+    })
+
+    post := func(target, token string, cookie *http.Cookie) (*http.Response, string) {
+        req := httptest.NewRequest("POST", target, nil)
+        req.AddCookie(cookie)
+        if token != "" {
+            req.Header.Set("X-CSRF-Token", token)
+        }
+        resp, err := app.Test(req)
+        if err != nil {
+            t.Fatalf("app.Test() error = %v", err)
+        }
+        buf := make([]byte, 256)
+        n, _ := resp.Body.Read(buf)
+        return resp, string(buf[:n])
+    }
+
+    resp, token := doRequest(t, app, "GET", "/form", nil)
+    cookie := sessionCookie(resp, "sid")
+
+    if resp, _ := post("/submit", "", cookie); resp.StatusCode != fiber.StatusForbidden {
+        t.Errorf("POST without token status = %d; want %d", resp.StatusCode, fiber.StatusForbidden)
+    }
+    if resp, _ := post("/submit", "wrong", cookie); resp.StatusCode != fiber.StatusForbidden {
+        t.Errorf("POST with wrong token status = %d; want %d", resp.StatusCode, fiber.StatusForbidden)
+    }
+    if resp, _ := post("/submit", token, cookie); resp.StatusCode != fiber.StatusOK {
+        t.Errorf("POST with token status = %d; want %d", resp.StatusCode, fiber.StatusOK)
+    }
+
+    // Rotating the session rotates the token
+    resp, newToken := post("/login", token, cookie)
+    if resp.StatusCode != fiber.StatusOK {
+        t.Fatalf("POST /login status = %d; want %d", resp.StatusCode, fiber.StatusOK)
+    }
+    if newToken == token {
+        t.Errorf("token was not rotated with the session ID")
+    }
+    newCookie := sessionCookie(resp, "sid")
+    if stored, _ := store.HGet(context.Background(), newCookie.Value, csrfTokenField); stored != newToken {
+        t.Errorf("stored token = %q; want %q", stored, newToken)
+    }
+    if resp, _ := post("/submit", token, newCookie); resp.StatusCode != fiber.StatusForbidden {
+        t.Errorf("POST with pre-rotation token status = %d; want %d", resp.StatusCode, fiber.StatusForbidden)
+    }
+    if resp, _ := post("/submit", newToken, newCookie); resp.StatusCode != fiber.StatusOK {
+        t.Errorf("POST with rotated token status = %d; want %d", resp.StatusCode, fiber.StatusOK)
+    }
+}
+
+func TestCSRFTokenAfterConcurrentRotation(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Use(NewCSRFMiddleware(CSRFConfig{}))
+    app.Get("/form", func(c *fiber.Ctx) error {
+        token, err := CSRFToken(c)
+        if err != nil {
+            return err
+        }
+        return c.SendString(token)
+    })
+    app.Post("/submit", func(c *fiber.Ctx) error {
+        return c.SendString("ok")
+    })
+
+    resp, token := doRequest(t, app, "GET", "/form", nil)
+    cookie := sessionCookie(resp, "sid")
+
+    // Make the session due for rotation
+    if err := store.HSet(context.Background(), cookie.Value, map[string]string{createdAtField: "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    // Two requests sent in parallel with the same cookie and token: the first
+    // rotates the session, the second follows the alias into the new session
+    for _, name := range []string{"rotating", "concurrent"} {
+        req := httptest.NewRequest("POST", "/submit", nil)
+        req.AddCookie(cookie)
+        req.Header.Set("X-CSRF-Token", token)
+        resp, err := app.Test(req)
+        if err != nil {
+            t.Fatalf("app.Test() error = %v", err)
+        }
+        if resp.StatusCode != fiber.StatusOK {
+            t.Errorf("%s request status = %d; want %d", name, resp.StatusCode, fiber.StatusOK)
+        }
+    }
+}
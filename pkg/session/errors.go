@@ -0,0 +1,145 @@
+package sessionutils
+
+import (
+    "errors"
+    "fmt"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/redis/go-redis/v9"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+// ErrStoreUnavailable is wrapped by the errors of a store that cannot be
+// reached, e.g. while Redis restarts. Use errors.Is to check for it.
+var ErrStoreUnavailable = errors.New("session store unavailable")
+
+// ErrSessionInvalid is wrapped by the errors caused by a malformed session,
+// e.g. bookkeeping fields that cannot be parsed
+var ErrSessionInvalid = errors.New("session invalid")
+
+// ephemeralSessionKey is the Fiber locals key marking a fail-open session
+const ephemeralSessionKey = "session_ephemeral"
+
+// FailurePolicy decides how a request continues when its session fails
+type FailurePolicy int
+
+const (
+    // FailClosed ends the request with the result of the ErrorHandler
+    FailClosed FailurePolicy = iota
+    // FailOpen continues with an ephemeral in-memory session that is
+    // dropped at the end of the request, see IsEphemeralSession
+    FailOpen
+    // FailSkip continues without a session, GetSessionID returns an error
+    FailSkip
+)
+
+// unavailable marks an error of the Redis client as ErrStoreUnavailable
+func unavailable(err error) error {
+    if err == nil || errors.Is(err, redis.Nil) || errors.Is(err, ErrStoreUnavailable) {
+        return err
+    }
+    return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+}
+
+// invalid returns an ErrSessionInvalid error
+func invalid(format string, args ...any) error {
+    return fmt.Errorf("%w: %s", ErrSessionInvalid, fmt.Sprintf(format, args...))
+}
+
+// errorStatus returns the HTTP status describing a session error
+func errorStatus(err error) int {
+    if errors.Is(err, ErrStoreUnavailable) {
+        return fiber.StatusServiceUnavailable
+    }
+    return fiber.StatusInternalServerError
+}
+
+// defaultErrorHandler responds with the status matching the error
+func defaultErrorHandler(c *fiber.Ctx, err error) error {
+    return fiber.NewError(errorStatus(err))
+}
+
+// failurePolicy returns the failure policy for the request
+func (config SessionMiddlewareConfig) failurePolicy(c *fiber.Ctx) FailurePolicy {
+    if config.FailurePolicyFor != nil {
+        return config.FailurePolicyFor(c)
+    }
+    return config.FailurePolicy
+}
+
+// logError logs a session error with the request details
+func logError(c *fiber.Ctx, err error) {
+    logx.StructuredErrorLog(requestContext(c), c.Method(), c.Path(), c.IP(), errorStatus(err), err)
+}
+
+// handleError logs an error that occurred before the handler ran and
+// continues as the failure policy says
+func (config SessionMiddlewareConfig) handleError(c *fiber.Ctx, err error) error {
+    var hookErr *hookError
+    if errors.As(err, &hookErr) {
+        return hookErr.err
+    }
+
+    logError(c, err)
+
+    switch config.failurePolicy(c) {
+    case FailOpen:
+        return config.failOpen(c)
+    case FailSkip:
+        c.Locals(sessionConfigKey, nil)
+        c.Locals(pendingSessionKey, nil)
+        c.Locals("session_id", nil)
+        return c.Next()
+    }
+
+    return config.ErrorHandler(c, err)
+}
+
+// handleCommitError logs an error storing a lazy session after the handler
+// ran. The response is already built, so only FailClosed changes the outcome.
+func (config SessionMiddlewareConfig) handleCommitError(c *fiber.Ctx, err error) error {
+    var hookErr *hookError
+    if errors.As(err, &hookErr) {
+        return hookErr.err
+    }
+
+    logError(c, err)
+
+    if config.failurePolicy(c) != FailClosed {
+        return nil
+    }
+    return config.ErrorHandler(c, err)
+}
+
+// failOpen continues the request with an in-memory session. It keeps the
+// session ID the client sent, so its real session is back once the store is.
+func (config SessionMiddlewareConfig) failOpen(c *fiber.Ctx) error {
+    sessionID, ok := readSessionID(c, config)
+    if !ok {
+        newSessionID, err := generateSessionID()
+        if err != nil {
+            return config.ErrorHandler(c, err)
+        }
+        sessionID = newSessionID
+    }
+
+    ephemeral := config
+    ephemeral.Store = NewMemoryStore(0)
+    ephemeral.Hooks = SessionHooks{}
+
+    c.Locals(sessionConfigKey, &ephemeral)
+    c.Locals(pendingSessionKey, nil)
+    c.Locals(ephemeralSessionKey, true)
+    c.Locals("session_id", sessionID)
+    c.SetUserContext(WithSessionID(c.UserContext(), sessionID))
+
+    return c.Next()
+}
+
+// IsEphemeralSession reports whether the request runs on a fail-open session
+// whose data is dropped at the end of the request
+func IsEphemeralSession(c *fiber.Ctx) bool {
+    ephemeral, _ := c.Locals(ephemeralSessionKey).(bool)
+    return ephemeral
+}
@@ -0,0 +1,137 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// downStore is a store whose backend is unreachable
+type downStore struct {
+    *MemoryStore
+}
+
+var errDown = unavailable(errors.New("connection refused"))
+
+func (downStore) HGetAll(ctx context.Context, sessionID string) (map[string]string, error) {
+    return nil, errDown
+}
+
+func (downStore) Touch(ctx context.Context, sessionID string, opts TouchOptions) (TouchResult, error) {
+    return TouchResult{}, errDown
+}
+
+func (downStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    return errDown
+}
+
+func TestSessionFailurePolicies(t *testing.T) {
+    store := downStore{NewMemoryStore(0)}
+    defer store.Close()
+
+    var handled error
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        ErrorHandler: func(c *fiber.Ctx, err error) error {
+            handled = err
+            return fiber.ErrServiceUnavailable
+        },
+        FailurePolicyFor: func(c *fiber.Ctx) FailurePolicy {
+            switch {
+            case strings.HasPrefix(c.Path(), "/public"):
+                return FailOpen
+            case strings.HasPrefix(c.Path(), "/health"):
+                return FailSkip
+            }
+            return FailClosed
+        },
+    }))
+    app.Get("/account", func(c *fiber.Ctx) error {
+        return c.SendString("account")
+    })
+    app.Get("/public", func(c *fiber.Ctx) error {
+        if !IsEphemeralSession(c) {
+            return c.SendString("not ephemeral")
+        }
+        if err := Set(c, "seen", true); err != nil {
+            return err
+        }
+        seen, err := Get[bool](c, "seen")
+        if err != nil || !seen {
+            return c.SendString("no data")
+        }
+        return c.SendString(MustGetSessionID(c))
+    })
+    app.Get("/health", func(c *fiber.Ctx) error {
+        if _, err := GetSessionID(c); err == nil {
+            return c.SendString("session")
+        }
+        return c.SendString("ok")
+    })
+
+    cookies := []*http.Cookie{{Name: "sid", Value: "abc"}}
+
+    resp, _ := doRequest(t, app, "GET", "/account", cookies)
+    if resp.StatusCode != fiber.StatusServiceUnavailable {
+        t.Errorf("fail closed status = %d; want %d", resp.StatusCode, fiber.StatusServiceUnavailable)
+    }
+    if !errors.Is(handled, ErrStoreUnavailable) {
+        t.Errorf("ErrorHandler got %v; want an error wrapping ErrStoreUnavailable", handled)
+    }
+
+    // The ephemeral session keeps the client's ID and leaves its cookie alone
+    resp, body := doRequest(t, app, "GET", "/public", cookies)
+    if body != "abc" {
+        t.Errorf("fail open body = %q; want %q", body, "abc")
+    }
+    if sessionCookie(resp, "sid") != nil {
+        t.Errorf("fail open replaced the session cookie")
+    }
+
+    if _, body := doRequest(t, app, "GET", "/health", cookies); body != "ok" {
+        t.Errorf("skip body = %q; want %q", body, "ok")
+    }
+}
+
+func TestInvalidSessionError(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    ctx := context.Background()
+    if err := store.HSet(ctx, "abc", map[string]string{createdAtField: "garbage"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    var handled error
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        ErrorHandler: func(c *fiber.Ctx, err error) error {
+            handled = err
+            return fiber.ErrBadRequest
+        },
+    }))
+    app.Get("/", func(c *fiber.Ctx) error {
+        return c.SendString("ok")
+    })
+
+    resp, _ := doRequest(t, app, "GET", "/", []*http.Cookie{{Name: "sid", Value: "abc"}})
+    if resp.StatusCode != fiber.StatusBadRequest {
+        t.Errorf("status = %d; want %d", resp.StatusCode, fiber.StatusBadRequest)
+    }
+    if !errors.Is(handled, ErrSessionInvalid) || errors.Is(handled, ErrStoreUnavailable) {
+        t.Errorf("ErrorHandler got %v; want an error wrapping only ErrSessionInvalid", handled)
+    }
+}
@@ -0,0 +1,205 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+// ExpiryEvent tells why a session key disappeared from Redis
+type ExpiryEvent string
+
+const (
+    SessionExpired ExpiryEvent = "expired" // the TTL of the key ran out
+    SessionDeleted ExpiryEvent = "del"     // the key was deleted, e.g. by Clear or a rotation
+)
+
+// maxReconnectBackoff caps the delay between reconnection attempts
+const maxReconnectBackoff = 30 * time.Second
+
+// ExpiryHandler is called for every session key that expired or was deleted.
+// For the sessions of a tenant, ctx carries the tenant, see TenantFromContext.
+type ExpiryHandler func(ctx context.Context, sessionID string, event ExpiryEvent)
+
+// ExpiryListenerConfig defines the config for the expiry listener
+type ExpiryListenerConfig struct {
+    RedisClient *redis.Client
+
+    // ConfigureServer enables the keyspace notifications the listener needs
+    // via CONFIG SET. Leave it off if the server is configured up front, or
+    // if CONFIG is not permitted, e.g. on managed Redis offerings.
+    ConfigureServer bool
+
+    App              string        // key namespace of the SessionManager, see SessionManager.App
+    ReconnectBackoff time.Duration // initial delay before resubscribing, defaults to 1s
+}
+
+// ExpiryListener subscribes to the Redis keyspace notifications of session
+// keys and dispatches them to the registered handlers. Redis delivers the
+// notifications at most once, so a handler may miss events while the listener
+// is reconnecting.
+type ExpiryListener struct {
+    config ExpiryListenerConfig
+
+    mu       sync.RWMutex
+    handlers []ExpiryHandler
+}
+
+// NewExpiryListener creates a listener. Register handlers with OnExpired,
+// then call Run in its own goroutine.
+func NewExpiryListener(config ExpiryListenerConfig) *ExpiryListener {
+    if config.ReconnectBackoff <= 0 {
+        config.ReconnectBackoff = time.Second
+    }
+
+    return &ExpiryListener{config: config}
+}
+
+// OnExpired registers a handler for expired and deleted sessions
+func (l *ExpiryListener) OnExpired(handler ExpiryHandler) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    l.handlers = append(l.handlers, handler)
+}
+
+// Run listens until ctx is done, reconnecting and resubscribing after a
+// dropped connection. It returns nil on shutdown.
+func (l *ExpiryListener) Run(ctx context.Context) error {
+    if l.config.RedisClient == nil {
+        return errors.New("expiry listener has no redis client")
+    }
+
+    backoff := l.config.ReconnectBackoff
+
+    for {
+        subscribed, err := l.listen(ctx)
+        if ctx.Err() != nil {
+            return nil
+        }
+        if subscribed {
+            backoff = l.config.ReconnectBackoff
+        }
+
+        logx.Warn(ctx, "session expiry listener disconnected, retrying in %s: %v", backoff, err)
+
+        timer := time.NewTimer(backoff)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return nil
+        case <-timer.C:
+        }
+
+        backoff *= 2
+        if backoff > maxReconnectBackoff {
+            backoff = maxReconnectBackoff
+        }
+    }
+}
+
+// listen runs a single subscription. It reports whether the subscription was
+// confirmed, so Run can reset its backoff.
+func (l *ExpiryListener) listen(ctx context.Context) (bool, error) {
+    client := l.config.RedisClient
+
+    if l.config.ConfigureServer {
+        if err := enableKeyspaceEvents(ctx, client); err != nil {
+            return false, err
+        }
+    }
+
+    db := client.Options().DB
+    pubsub := client.PSubscribe(ctx,
+        fmt.Sprintf("__keyevent@%d__:%s", db, SessionExpired),
+        fmt.Sprintf("__keyevent@%d__:%s", db, SessionDeleted),
+    )
+    defer pubsub.Close()
+
+    // Wait for the confirmation, so a broken connection surfaces here
+    if _, err := pubsub.Receive(ctx); err != nil {
+        return false, fmt.Errorf("failed to subscribe to keyspace events: %w", err)
+    }
+
+    for {
+        msg, err := pubsub.ReceiveMessage(ctx)
+        if err != nil {
+            return true, err
+        }
+
+        l.handleMessage(ctx, msg.Channel, msg.Payload)
+    }
+}
+
+// handleMessage dispatches a keyevent notification if its key is a session key.
+// The channel names the event, the payload is the key.
+func (l *ExpiryListener) handleMessage(ctx context.Context, channel, key string) {
+    tenant, sessionID, ok := parseSessionKey(l.config.App, key)
+    if !ok {
+        return
+    }
+
+    if tenant != "" {
+        ctx = WithTenant(ctx, tenant)
+    }
+
+    event := ExpiryEvent(channel[strings.LastIndexByte(channel, ':')+1:])
+    l.dispatch(ctx, sessionID, event)
+}
+
+// dispatch calls the registered handlers
+func (l *ExpiryListener) dispatch(ctx context.Context, sessionID string, event ExpiryEvent) {
+    l.mu.RLock()
+    handlers := l.handlers
+    l.mu.RUnlock()
+
+    for _, handler := range handlers {
+        handler(ctx, sessionID, event)
+    }
+}
+
+// enableKeyspaceEvents adds the flags for keyevent notifications of expired
+// and deleted keys to the server's notify-keyspace-events setting
+func enableKeyspaceEvents(ctx context.Context, client *redis.Client) error {
+    current, err := client.ConfigGet(ctx, "notify-keyspace-events").Result()
+    if err != nil {
+        return fmt.Errorf("failed to read notify-keyspace-events: %w", err)
+    }
+
+    flags := current["notify-keyspace-events"]
+    merged := mergeNotifyFlags(flags)
+    if merged == flags {
+        return nil
+    }
+
+    if err := client.ConfigSet(ctx, "notify-keyspace-events", merged).Err(); err != nil {
+        return fmt.Errorf("failed to enable keyspace events: %w", err)
+    }
+
+    return nil
+}
+
+// mergeNotifyFlags adds E (keyevent channels), g (generic commands like DEL)
+// and x (expired) to flags, keeping whatever else is enabled
+func mergeNotifyFlags(flags string) string {
+    required := "Egx"
+    if strings.Contains(flags, "A") {
+        // A is an alias for all event classes, including g and x
+        required = "E"
+    }
+
+    for _, flag := range required {
+        if !strings.ContainsRune(flags, flag) {
+            flags += string(flag)
+        }
+    }
+
+    return flags
+}
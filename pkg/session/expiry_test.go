@@ -0,0 +1,68 @@
+package sessionutils
+
+import (
+    "context"
+    "slices"
+    "testing"
+)
+
+func TestMergeNotifyFlags(t *testing.T) {
+    tests := []struct {
+        flags string
+        want  string
+    }{
+        {flags: "", want: "Egx"},
+        {flags: "Ex", want: "Exg"},
+        {flags: "KEA", want: "KEA"},
+        {flags: "KA", want: "KAE"},
+        {flags: "Egx", want: "Egx"},
+    }
+
+    for _, tt := range tests {
+        if got := mergeNotifyFlags(tt.flags); got != tt.want {
+            t.Errorf("mergeNotifyFlags(%q) = %q; want %q", tt.flags, got, tt.want)
+        }
+    }
+}
+
+func TestExpiryListenerHandleMessage(t *testing.T) {
+    type call struct {
+        tenant    string
+        sessionID string
+        event     ExpiryEvent
+    }
+
+    listener := NewExpiryListener(ExpiryListenerConfig{App: "shop"})
+
+    var calls []call
+    for range 2 {
+        listener.OnExpired(func(ctx context.Context, sessionID string, event ExpiryEvent) {
+            calls = append(calls, call{TenantFromContext(ctx), sessionID, event})
+        })
+    }
+
+    messages := []struct {
+        channel string
+        key     string
+    }{
+        {"__keyevent@0__:expired", "shop:session:abc"},
+        {"__keyevent@0__:del", "shop:acme:session:def"},
+        {"__keyevent@0__:expired", "shop:session_user:42"},
+        {"__keyevent@0__:expired", "blog:session:abc"},
+        {"__keyevent@0__:del", "shop:session:"},
+    }
+    for _, msg := range messages {
+        listener.handleMessage(context.Background(), msg.channel, msg.key)
+    }
+
+    // Every handler sees every session key, other keys are ignored
+    want := []call{
+        {"", "abc", SessionExpired},
+        {"", "abc", SessionExpired},
+        {"acme", "def", SessionDeleted},
+        {"acme", "def", SessionDeleted},
+    }
+    if !slices.Equal(calls, want) {
+        t.Errorf("handlers were called with %v; want %v", calls, want)
+    }
+}
@@ -0,0 +1,452 @@
+package sessionutils
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// fakeRedis is a minimal Redis server speaking RESP2, with the hash, set,
+// transaction and pub/sub commands the SessionManager uses outside of Lua
+// scripts, including WATCH. It lets tests run a real go-redis client without
+// a Redis server.
+type fakeRedis struct {
+    t        *testing.T
+    listener net.Listener
+
+    mu          sync.Mutex
+    hashes      map[string]map[string]string
+    sets        map[string]map[string]struct{}
+    subscribers map[string]map[*fakeConn]struct{}
+    conns       map[*fakeConn]struct{}
+    calls       map[string]int
+    versions    map[string]int // bumped by every write of a key, for WATCH
+    after       map[string]func()
+    wg          sync.WaitGroup
+}
+
+// fakeConn is a client connection of fakeRedis
+type fakeConn struct {
+    conn net.Conn
+
+    mu       sync.Mutex // serializes replies and pushed messages
+    queue    [][]string // commands queued by MULTI, nil outside a transaction
+    inMulti  bool
+    channels map[string]struct{}
+    watched  map[string]int // watched keys and their versions at WATCH
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+    t.Helper()
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("net.Listen() error = %v", err)
+    }
+
+    fr := &fakeRedis{
+        t:           t,
+        listener:    listener,
+        hashes:      make(map[string]map[string]string),
+        sets:        make(map[string]map[string]struct{}),
+        subscribers: make(map[string]map[*fakeConn]struct{}),
+        conns:       make(map[*fakeConn]struct{}),
+        calls:       make(map[string]int),
+        versions:    make(map[string]int),
+        after:       make(map[string]func()),
+    }
+
+    fr.wg.Add(1)
+    go fr.accept()
+    t.Cleanup(fr.Close)
+
+    return fr
+}
+
+// client returns a go-redis client of the server
+func (fr *fakeRedis) client() *redis.Client {
+    client := redis.NewClient(&redis.Options{
+        Addr:            fr.listener.Addr().String(),
+        Protocol:        2,
+        DisableIdentity: true,
+    })
+    fr.t.Cleanup(func() { client.Close() })
+    return client
+}
+
+// Close stops the server and drops every connection
+func (fr *fakeRedis) Close() {
+    fr.listener.Close()
+
+    fr.mu.Lock()
+    for fc := range fr.conns {
+        fc.conn.Close()
+    }
+    fr.mu.Unlock()
+
+    fr.wg.Wait()
+}
+
+// Calls returns how often a command was run
+func (fr *fakeRedis) Calls(name string) int {
+    fr.mu.Lock()
+    defer fr.mu.Unlock()
+    return fr.calls[name]
+}
+
+// HSet sets a field of a hash, for seeding test data
+func (fr *fakeRedis) HSet(key, field, value string) {
+    fr.mu.Lock()
+    defer fr.mu.Unlock()
+
+    fr.versions[key]++
+    if fr.hashes[key] == nil {
+        fr.hashes[key] = make(map[string]string)
+    }
+    fr.hashes[key][field] = value
+}
+
+// SAdd adds members to a set, for seeding test data
+func (fr *fakeRedis) SAdd(key string, members ...string) {
+    fr.mu.Lock()
+    defer fr.mu.Unlock()
+    fr.sadd(key, members)
+}
+
+// After runs fn once right after the next command called name, e.g. to
+// write concurrently between the reads and the EXEC of a transaction
+func (fr *fakeRedis) After(name string, fn func()) {
+    fr.mu.Lock()
+    defer fr.mu.Unlock()
+    fr.after[name] = fn
+}
+
+func (fr *fakeRedis) accept() {
+    defer fr.wg.Done()
+
+    for {
+        conn, err := fr.listener.Accept()
+        if err != nil {
+            return
+        }
+
+        fc := &fakeConn{conn: conn, channels: make(map[string]struct{}), watched: make(map[string]int)}
+        fr.mu.Lock()
+        fr.conns[fc] = struct{}{}
+        fr.mu.Unlock()
+
+        fr.wg.Add(1)
+        go fr.serve(fc)
+    }
+}
+
+func (fr *fakeRedis) serve(fc *fakeConn) {
+    defer fr.wg.Done()
+    defer func() {
+        fr.mu.Lock()
+        delete(fr.conns, fc)
+        for channel := range fc.channels {
+            delete(fr.subscribers[channel], fc)
+        }
+        fr.mu.Unlock()
+        fc.conn.Close()
+    }()
+
+    r := bufio.NewReader(fc.conn)
+    for {
+        args, err := readCommand(r)
+        if err != nil {
+            if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+                fr.t.Logf("fake redis: %v", err)
+            }
+            return
+        }
+
+        var reply bytes.Buffer
+        fr.handle(fc, args, &reply)
+
+        fc.mu.Lock()
+        _, err = fc.conn.Write(reply.Bytes())
+        fc.mu.Unlock()
+        if err != nil {
+            return
+        }
+    }
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+    line, err := readLine(r)
+    if err != nil {
+        return nil, err
+    }
+    if !strings.HasPrefix(line, "*") {
+        return nil, fmt.Errorf("unexpected command line %q", line)
+    }
+    n, err := strconv.Atoi(line[1:])
+    if err != nil {
+        return nil, err
+    }
+
+    args := make([]string, n)
+    for i := range args {
+        line, err := readLine(r)
+        if err != nil {
+            return nil, err
+        }
+        if !strings.HasPrefix(line, "$") {
+            return nil, fmt.Errorf("unexpected argument line %q", line)
+        }
+        size, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        buf := make([]byte, size+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        args[i] = string(buf[:size])
+    }
+    return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+func writeBulk(w *bytes.Buffer, s string) {
+    fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeArray(w *bytes.Buffer, items ...string) {
+    fmt.Fprintf(w, "*%d\r\n", len(items))
+    for _, item := range items {
+        writeBulk(w, item)
+    }
+}
+
+func writeInt(w *bytes.Buffer, n int) {
+    fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// handle runs a command on the connection, queueing it inside MULTI
+func (fr *fakeRedis) handle(fc *fakeConn, args []string, w *bytes.Buffer) {
+    name := strings.ToUpper(args[0])
+
+    switch {
+    case name == "MULTI":
+        fc.inMulti = true
+        fc.queue = nil
+        w.WriteString("+OK\r\n")
+        return
+
+    case name == "EXEC":
+        queue := fc.queue
+        fc.inMulti = false
+        fc.queue = nil
+
+        fr.mu.Lock()
+        defer fr.mu.Unlock()
+
+        watched := fc.watched
+        fc.watched = make(map[string]int)
+        for key, version := range watched {
+            if fr.versions[key] != version {
+                // A watched key changed, the transaction is aborted
+                w.WriteString("*-1\r\n")
+                return
+            }
+        }
+
+        fmt.Fprintf(w, "*%d\r\n", len(queue))
+        for _, queued := range queue {
+            fr.run(fc, queued, w)
+        }
+        return
+
+    case name == "DISCARD":
+        fc.inMulti = false
+        fc.queue = nil
+        w.WriteString("+OK\r\n")
+        return
+
+    case fc.inMulti:
+        fc.queue = append(fc.queue, args)
+        w.WriteString("+QUEUED\r\n")
+        return
+    }
+
+    fr.mu.Lock()
+    fr.run(fc, args, w)
+    after := fr.after[name]
+    delete(fr.after, name)
+    fr.mu.Unlock()
+
+    if after != nil {
+        after()
+    }
+}
+
+// run executes a single command. The caller holds mu.
+func (fr *fakeRedis) run(fc *fakeConn, args []string, w *bytes.Buffer) {
+    name := strings.ToUpper(args[0])
+    fr.calls[name]++
+
+    switch name {
+    case "PING":
+        if len(fc.channels) > 0 {
+            writeArray(w, "pong", "")
+            return
+        }
+        w.WriteString("+PONG\r\n")
+
+    case "WATCH":
+        for _, key := range args[1:] {
+            fc.watched[key] = fr.versions[key]
+        }
+        w.WriteString("+OK\r\n")
+
+    case "UNWATCH":
+        fc.watched = make(map[string]int)
+        w.WriteString("+OK\r\n")
+
+    case "HSET":
+        fr.versions[args[1]]++
+        hash := fr.hashes[args[1]]
+        if hash == nil {
+            hash = make(map[string]string)
+            fr.hashes[args[1]] = hash
+        }
+        added := 0
+        for i := 2; i+1 < len(args); i += 2 {
+            if _, ok := hash[args[i]]; !ok {
+                added++
+            }
+            hash[args[i]] = args[i+1]
+        }
+        writeInt(w, added)
+
+    case "HGET":
+        value, ok := fr.hashes[args[1]][args[2]]
+        if !ok {
+            w.WriteString("$-1\r\n")
+            return
+        }
+        writeBulk(w, value)
+
+    case "HGETALL":
+        var items []string
+        for field, value := range fr.hashes[args[1]] {
+            items = append(items, field, value)
+        }
+        writeArray(w, items...)
+
+    case "DEL":
+        deleted := 0
+        for _, key := range args[1:] {
+            fr.versions[key]++
+            if _, ok := fr.hashes[key]; ok {
+                delete(fr.hashes, key)
+                deleted++
+            }
+            if _, ok := fr.sets[key]; ok {
+                delete(fr.sets, key)
+                deleted++
+            }
+        }
+        writeInt(w, deleted)
+
+    case "SADD":
+        writeInt(w, fr.sadd(args[1], args[2:]))
+
+    case "SMEMBERS":
+        var members []string
+        for member := range fr.sets[args[1]] {
+            members = append(members, member)
+        }
+        writeArray(w, members...)
+
+    case "SREM":
+        fr.versions[args[1]]++
+        removed := 0
+        for _, member := range args[2:] {
+            if _, ok := fr.sets[args[1]][member]; ok {
+                delete(fr.sets[args[1]], member)
+                removed++
+            }
+        }
+        writeInt(w, removed)
+
+    case "PUBLISH":
+        var message bytes.Buffer
+        writeArray(&message, "message", args[1], args[2])
+        for sub := range fr.subscribers[args[1]] {
+            sub.mu.Lock()
+            sub.conn.Write(message.Bytes())
+            sub.mu.Unlock()
+        }
+        writeInt(w, len(fr.subscribers[args[1]]))
+
+    case "SUBSCRIBE":
+        for _, channel := range args[1:] {
+            if fr.subscribers[channel] == nil {
+                fr.subscribers[channel] = make(map[*fakeConn]struct{})
+            }
+            fr.subscribers[channel][fc] = struct{}{}
+            fc.channels[channel] = struct{}{}
+            fmt.Fprintf(w, "*3\r\n")
+            writeBulk(w, "subscribe")
+            writeBulk(w, channel)
+            writeInt(w, len(fc.channels))
+        }
+
+    case "UNSUBSCRIBE":
+        channels := args[1:]
+        if len(channels) == 0 {
+            for channel := range fc.channels {
+                channels = append(channels, channel)
+            }
+        }
+        for _, channel := range channels {
+            delete(fr.subscribers[channel], fc)
+            delete(fc.channels, channel)
+            fmt.Fprintf(w, "*3\r\n")
+            writeBulk(w, "unsubscribe")
+            writeBulk(w, channel)
+            writeInt(w, len(fc.channels))
+        }
+
+    default:
+        fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+    }
+}
+
+func (fr *fakeRedis) sadd(key string, members []string) int {
+    fr.versions[key]++
+    set := fr.sets[key]
+    if set == nil {
+        set = make(map[string]struct{})
+        fr.sets[key] = set
+    }
+    added := 0
+    for _, member := range members {
+        if _, ok := set[member]; !ok {
+            set[member] = struct{}{}
+            added++
+        }
+    }
+    return added
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package sessionutils
+
+import (
+    "os"
+    "sync"
+)
+
+// Without flock, writers are only serialized within the process, so the
+// FileStore directory must not be shared by several processes
+var fileLockMu sync.Mutex
+
+// lockProcess serializes the writers of the process. lockDirs takes it once
+// for all the directories it locks, the mutex is not reentrant.
+func lockProcess() func() {
+    fileLockMu.Lock()
+    return fileLockMu.Unlock
+}
+
+func lockFile(f *os.File) error {
+    return nil
+}
+
+func unlockFile(f *os.File) error {
+    return nil
+}
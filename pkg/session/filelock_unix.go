@@ -0,0 +1,23 @@
+//go:build unix
+
+package sessionutils
+
+import (
+    "os"
+    "syscall"
+)
+
+// lockProcess is a no-op, flock also serializes the goroutines of a process
+func lockProcess() func() {
+    return func() {}
+}
+
+// lockFile takes an exclusive flock on f, waiting for other holders
+func lockFile(f *os.File) error {
+    return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile releases the flock on f
+func unlockFile(f *os.File) error {
+    return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
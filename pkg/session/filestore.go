@@ -0,0 +1,915 @@
+package sessionutils
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "maps"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    fileLockName   = ".lock"
+    fileTempPrefix = ".tmp-"
+    fileIndexDir   = "users" // holds the user index files
+
+    // staleTempAge is how old a temporary file left by a crashed writer must be
+    // before the sweeper removes it
+    staleTempAge = time.Hour
+)
+
+// fileSession is the content of a session file. A user index file has the
+// same format, with the path of each session file keyed by its session ID.
+type fileSession struct {
+    ExpiresAt int64      `json:"expires_at,omitempty"` // Unix nanoseconds, 0 means no expiry
+    Values    fileValues `json:"values"`
+}
+
+// fileValues are the fields of a session file. They are stored base64
+// encoded, values of binary codecs are not valid UTF-8.
+type fileValues map[string]string
+
+func (v fileValues) MarshalJSON() ([]byte, error) {
+    encoded := make(map[string]string, len(v))
+    for k, value := range v {
+        encoded[k] = base64.StdEncoding.EncodeToString([]byte(value))
+    }
+    return json.Marshal(encoded)
+}
+
+func (v *fileValues) UnmarshalJSON(data []byte) error {
+    var encoded map[string]string
+    if err := json.Unmarshal(data, &encoded); err != nil {
+        return err
+    }
+
+    values := make(fileValues, len(encoded))
+    for k, value := range encoded {
+        decoded, err := base64.StdEncoding.DecodeString(value)
+        if err != nil {
+            return fmt.Errorf("field %q: %w", k, err)
+        }
+        values[k] = string(decoded)
+    }
+    *v = values
+    return nil
+}
+
+func (s *fileSession) expired(now time.Time) bool {
+    return s.ExpiresAt != 0 && now.UnixNano() >= s.ExpiresAt
+}
+
+// FileStoreConfig defines the config for the file store
+type FileStoreConfig struct {
+    Dir             string        // directory of the session files, created if missing
+    CleanupInterval time.Duration // how often expired sessions are removed, 0 disables the sweeper
+
+    // Codec encodes the values of Save and LoadJSON, defaults to JSONCodec
+    Codec Codec
+
+    // CompressAbove compresses encoded values larger than this many bytes, 0 disables compression
+    CompressAbove int
+}
+
+// FileStore is a Store keeping one file per session in a directory, for
+// installations that cannot run Redis. Files are spread over two levels of
+// subdirectories by the hash of the session ID and replaced atomically by
+// renaming a temporary file. Writers lock the subdirectory of the session
+// with flock, so several processes on one host can share the directory; it
+// must not be on a network file system. Expired sessions are never returned
+// and are removed by the sweeper. Each user has an index file of their
+// sessions, which is locked together with the sessions it changes with.
+type FileStore struct {
+    dir           string
+    codec         Codec
+    compressAbove int
+
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+// NewFileStore creates a file store. If CleanupInterval is positive,
+// expired sessions are removed in the background until Close is called.
+func NewFileStore(config FileStoreConfig) (*FileStore, error) {
+    if config.Dir == "" {
+        return nil, errors.New("file store needs a directory")
+    }
+    if err := checkCodec(config.Codec); err != nil {
+        return nil, err
+    }
+    if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+        return nil, fmt.Errorf("failed to create session directory: %w", err)
+    }
+
+    store := &FileStore{
+        dir:           config.Dir,
+        codec:         config.Codec,
+        compressAbove: config.CompressAbove,
+        stop:          make(chan struct{}),
+    }
+
+    if config.CleanupInterval > 0 {
+        go store.cleanupLoop(config.CleanupInterval)
+    }
+
+    return store, nil
+}
+
+// Close stops the background sweeper
+func (fs *FileStore) Close() {
+    fs.stopOnce.Do(func() {
+        close(fs.stop)
+    })
+}
+
+func (fs *FileStore) cleanupLoop(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-fs.stop:
+            return
+        case <-ticker.C:
+            _ = fs.DeleteExpired()
+        }
+    }
+}
+
+// path returns the file of a session. The tenant in ctx is part of the hash,
+// so the sessions of different tenants never share a file.
+func (fs *FileStore) path(ctx context.Context, sessionID string) string {
+    sum := sha256.Sum256([]byte(keyNamespace("", TenantFromContext(ctx)) + sessionID))
+    name := hex.EncodeToString(sum[:])
+    return filepath.Join(fs.dir, name[:2], name[2:4], name)
+}
+
+// indexPath returns the index file of a user's sessions
+func (fs *FileStore) indexPath(ctx context.Context, userID string) string {
+    sum := sha256.Sum256([]byte(keyNamespace("", TenantFromContext(ctx)) + userIndexPrefix + userID))
+    name := hex.EncodeToString(sum[:])
+    return filepath.Join(fs.dir, fileIndexDir, name[:2], name[2:4], name)
+}
+
+// readSessionFile returns the live session stored in path, or nil if there is none
+func readSessionFile(path string, now time.Time) (*fileSession, error) {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read session file: %w", err)
+    }
+
+    var session fileSession
+    if err := json.Unmarshal(data, &session); err != nil {
+        return nil, invalid("malformed session file %s: %v", filepath.Base(path), err)
+    }
+    if session.expired(now) {
+        return nil, nil
+    }
+
+    return &session, nil
+}
+
+// writeSessionFile replaces the session in path by writing a temporary file
+// and renaming it. An empty session is removed, like Redis removes an empty hash.
+func writeSessionFile(path string, session *fileSession) error {
+    if session == nil || len(session.Values) == 0 {
+        if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+            return fmt.Errorf("failed to remove session file: %w", err)
+        }
+        return nil
+    }
+
+    data, err := json.Marshal(session)
+    if err != nil {
+        return fmt.Errorf("failed to marshal session file: %w", err)
+    }
+
+    tmp, err := os.CreateTemp(filepath.Dir(path), fileTempPrefix+"*")
+    if err != nil {
+        return fmt.Errorf("failed to create session file: %w", err)
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to write session file: %w", err)
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return fmt.Errorf("failed to write session file: %w", err)
+    }
+    if err := tmp.Close(); err != nil {
+        return fmt.Errorf("failed to write session file: %w", err)
+    }
+
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        return fmt.Errorf("failed to replace session file: %w", err)
+    }
+
+    return nil
+}
+
+// lockDirs takes the write locks of the directories of paths, in a fixed
+// order so two writers cannot deadlock. The returned function releases them.
+func lockDirs(paths ...string) (func(), error) {
+    var dirs []string
+    for _, path := range paths {
+        dirs = append(dirs, filepath.Dir(path))
+    }
+    slices.Sort(dirs)
+    dirs = slices.Compact(dirs)
+
+    unlockProcess := lockProcess()
+
+    var locks []*os.File
+    unlock := func() {
+        for i := len(locks) - 1; i >= 0; i-- {
+            _ = unlockFile(locks[i])
+            locks[i].Close()
+        }
+        unlockProcess()
+    }
+
+    for _, dir := range dirs {
+        if err := os.MkdirAll(dir, 0o700); err != nil {
+            unlock()
+            return nil, fmt.Errorf("failed to create session directory: %w", err)
+        }
+
+        f, err := os.OpenFile(filepath.Join(dir, fileLockName), os.O_RDWR|os.O_CREATE, 0o600)
+        if err != nil {
+            unlock()
+            return nil, fmt.Errorf("failed to open session lock: %w", err)
+        }
+        if err := lockFile(f); err != nil {
+            f.Close()
+            unlock()
+            return nil, fmt.Errorf("failed to lock session directory: %w", err)
+        }
+        locks = append(locks, f)
+    }
+
+    return unlock, nil
+}
+
+// modify runs fn on the live session under the directory lock and stores
+// the result. fn gets nil if the session does not exist and returns the
+// session to store, nil to remove it, or errNoChange.
+func (fs *FileStore) modify(ctx context.Context, sessionID string, fn func(session *fileSession) (*fileSession, error)) error {
+    path := fs.path(ctx, sessionID)
+
+    unlock, err := lockDirs(path)
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    // A malformed file is overwritten, so it does not block writes forever
+    session, err := readSessionFile(path, time.Now())
+    if err != nil && !errors.Is(err, ErrSessionInvalid) {
+        return err
+    }
+
+    session, err = fn(session)
+    if errors.Is(err, errNoChange) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    return writeSessionFile(path, session)
+}
+
+// errNoChange tells modify to leave the session file alone
+var errNoChange = errors.New("no change")
+
+// newFileSession returns session, or a new empty one if it is nil
+func newFileSession(session *fileSession) *fileSession {
+    if session == nil {
+        return &fileSession{Values: make(map[string]string)}
+    }
+    if session.Values == nil {
+        session.Values = make(map[string]string)
+    }
+    return session
+}
+
+// Save saves a Go value into the session
+func (fs *FileStore) Save(ctx context.Context, sessionID, key string, value any) error {
+    data, err := fs.encodeValue(value)
+    if err != nil {
+        return err
+    }
+
+    return fs.HSet(ctx, sessionID, map[string]string{key: string(data)})
+}
+
+// Load loads a raw value (as []byte) from the session, as its codec encoded it
+func (fs *FileStore) Load(ctx context.Context, sessionID, key string) ([]byte, error) {
+    value, err := fs.HGet(ctx, sessionID, key)
+    if err != nil {
+        return nil, err
+    }
+    return valuePayload([]byte(value))
+}
+
+// LoadJSON unmarshals a Go value from the session
+func (fs *FileStore) LoadJSON(ctx context.Context, sessionID, key string, dest any) error {
+    value, err := fs.HGet(ctx, sessionID, key)
+    if err != nil {
+        return err
+    }
+
+    return fs.decodeValue([]byte(value), dest)
+}
+
+func (fs *FileStore) encodeValue(value any) ([]byte, error) {
+    data, err := encodeValue(fs.codec, fs.compressAbove, value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal session value: %w", err)
+    }
+    return data, nil
+}
+
+func (fs *FileStore) decodeValue(data []byte, dest any) error {
+    if err := decodeValue(fs.codec, data, dest); err != nil {
+        return fmt.Errorf("failed to unmarshal session value: %w", err)
+    }
+    return nil
+}
+
+// Delete deletes a key from the session
+func (fs *FileStore) Delete(ctx context.Context, sessionID, key string) error {
+    return fs.modify(ctx, sessionID, func(session *fileSession) (*fileSession, error) {
+        if session == nil {
+            return nil, errNoChange
+        }
+        if _, ok := session.Values[key]; !ok {
+            return nil, errNoChange
+        }
+        delete(session.Values, key)
+        return session, nil
+    })
+}
+
+// Clear deletes the entire session and removes it from its user's index
+func (fs *FileStore) Clear(ctx context.Context, sessionID string) error {
+    path := fs.path(ctx, sessionID)
+
+    unlock, err := fs.lockWithIndexes(ctx, []string{path})
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    userID, err := sessionUser(path, time.Now())
+    if err != nil {
+        return err
+    }
+    if err := writeSessionFile(path, nil); err != nil {
+        return err
+    }
+
+    return fs.updateIndex(ctx, userID, sessionID, false)
+}
+
+// HSet sets multiple fields in the session
+func (fs *FileStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    if len(values) == 0 {
+        return nil
+    }
+
+    return fs.modify(ctx, sessionID, func(session *fileSession) (*fileSession, error) {
+        session = newFileSession(session)
+        for k, v := range values {
+            session.Values[k] = v
+        }
+        return session, nil
+    })
+}
+
+// HGetAll gets all fields from the session. Files are replaced atomically,
+// so reads need no lock.
+func (fs *FileStore) HGetAll(ctx context.Context, sessionID string) (map[string]string, error) {
+    session, err := readSessionFile(fs.path(ctx, sessionID), time.Now())
+    if err != nil {
+        return nil, err
+    }
+
+    result := make(map[string]string)
+    if session != nil {
+        for k, v := range session.Values {
+            result[k] = v
+        }
+    }
+
+    return result, nil
+}
+
+// HGet gets a single field from the session
+func (fs *FileStore) HGet(ctx context.Context, sessionID, key string) (string, error) {
+    session, err := readSessionFile(fs.path(ctx, sessionID), time.Now())
+    if err != nil {
+        return "", err
+    }
+    if session == nil {
+        return "", &notFoundError{key: key}
+    }
+
+    value, ok := session.Values[key]
+    if !ok {
+        return "", &notFoundError{key: key}
+    }
+
+    return value, nil
+}
+
+// Expire sets an expiration time for the session
+func (fs *FileStore) Expire(ctx context.Context, sessionID string, expiration time.Duration) error {
+    // A non-positive TTL deletes the key, as in Redis
+    if expiration <= 0 {
+        return fs.Clear(ctx, sessionID)
+    }
+
+    return fs.modify(ctx, sessionID, func(session *fileSession) (*fileSession, error) {
+        if session == nil {
+            return nil, errNoChange
+        }
+        session.ExpiresAt = time.Now().Add(expiration).UnixNano()
+        return session, nil
+    })
+}
+
+// Touch reads, writes and refreshes a session in one step
+func (fs *FileStore) Touch(ctx context.Context, sessionID string, opts TouchOptions) (TouchResult, error) {
+    var result TouchResult
+
+    err := fs.modify(ctx, sessionID, func(session *fileSession) (*fileSession, error) {
+        if session == nil {
+            return nil, &notFoundError{key: opts.Required}
+        }
+        if _, ok := session.Values[opts.Required]; !ok {
+            return nil, &notFoundError{key: opts.Required}
+        }
+
+        result.Values = make(map[string]string)
+        for _, field := range opts.Fields {
+            if value, ok := session.Values[field]; ok {
+                result.Values[field] = value
+            }
+        }
+        for k, v := range opts.Match {
+            if session.Values[k] != v {
+                return nil, errNoChange
+            }
+        }
+        result.Matched = true
+
+        for k, v := range opts.Set {
+            session.Values[k] = v
+        }
+
+        now := time.Now()
+        if opts.TTL > 0 {
+            // Like PTTL, a session without expiry counts as below any threshold
+            remaining := time.Duration(session.ExpiresAt - now.UnixNano())
+            if opts.RefreshBelow <= 0 || session.ExpiresAt == 0 || remaining < opts.RefreshBelow {
+                session.ExpiresAt = now.Add(opts.TTL).UnixNano()
+                result.Refreshed = true
+            }
+        }
+        if len(opts.Set) == 0 && !result.Refreshed {
+            return nil, errNoChange
+        }
+
+        return session, nil
+    })
+
+    return result, err
+}
+
+// Update replaces the raw value of a session key under the session's lock
+func (fs *FileStore) Update(ctx context.Context, sessionID, key string, fn func(old []byte) ([]byte, error)) error {
+    return fs.UpdateSession(ctx, sessionID, func(values map[string]string) error {
+        var old []byte
+        if v, ok := values[key]; ok {
+            old = []byte(v)
+        }
+
+        value, err := fn(old)
+        if err != nil {
+            return err
+        }
+
+        if value == nil {
+            delete(values, key)
+        } else {
+            values[key] = string(value)
+        }
+        return nil
+    })
+}
+
+// UpdateSession changes several fields of a session at once under the
+// session's lock, so fn runs exactly once
+func (fs *FileStore) UpdateSession(ctx context.Context, sessionID string, fn func(values map[string]string) error) error {
+    return fs.modify(ctx, sessionID, func(session *fileSession) (*fileSession, error) {
+        session = newFileSession(session)
+        if err := fn(session.Values); err != nil {
+            return nil, err
+        }
+        return session, nil
+    })
+}
+
+// RotateSession atomically moves a session to a new ID, along with its
+// entry in the user index
+func (fs *FileStore) RotateSession(ctx context.Context, oldSessionID, newSessionID string, opts RotateOptions) (string, error) {
+    oldPath, newPath := fs.path(ctx, oldSessionID), fs.path(ctx, newSessionID)
+
+    unlock, err := fs.lockWithIndexes(ctx, []string{oldPath, newPath}, opts.Fields[userIDField])
+    if err != nil {
+        return "", err
+    }
+    defer unlock()
+
+    now := time.Now()
+    values := make(map[string]string)
+
+    old, err := readSessionFile(oldPath, now)
+    if err != nil && (opts.KeepData || !errors.Is(err, ErrSessionInvalid)) {
+        return "", err
+    }
+
+    var oldUserID string
+    if old != nil {
+        if opts.KeepData {
+            if target, ok := old.Values[rotatedToField]; ok {
+                return target, nil
+            }
+            for k, v := range old.Values {
+                values[k] = v
+            }
+        }
+        oldUserID = old.Values[userIDField]
+    }
+
+    for k, v := range opts.Fields {
+        values[k] = v
+    }
+
+    session := &fileSession{Values: values}
+    if opts.TTL > 0 {
+        session.ExpiresAt = now.Add(opts.TTL).UnixNano()
+    }
+    if err := writeSessionFile(newPath, session); err != nil {
+        return "", err
+    }
+
+    var alias *fileSession
+    if opts.Grace > 0 {
+        alias = &fileSession{
+            ExpiresAt: now.Add(opts.Grace).UnixNano(),
+            Values:    map[string]string{rotatedToField: newSessionID},
+        }
+    }
+    if err := writeSessionFile(oldPath, alias); err != nil {
+        return "", err
+    }
+
+    if err := fs.updateIndex(ctx, oldUserID, oldSessionID, false); err != nil {
+        return "", err
+    }
+    if err := fs.updateIndex(ctx, values[userIDField], newSessionID, true); err != nil {
+        return "", err
+    }
+
+    return newSessionID, nil
+}
+
+// sessionUser returns the user a session file is bound to, "" if there is none
+func sessionUser(path string, now time.Time) (string, error) {
+    session, err := readSessionFile(path, now)
+    if errors.Is(err, ErrSessionInvalid) {
+        return "", nil
+    }
+    if err != nil || session == nil {
+        return "", err
+    }
+    return session.Values[userIDField], nil
+}
+
+// lockWithIndexes locks the directories of the session files in paths
+// together with the index files of their users and of userIDs. The users
+// are read before the lock is taken, so it retries until they did not change.
+func (fs *FileStore) lockWithIndexes(ctx context.Context, paths []string, userIDs ...string) (func(), error) {
+    owners := func() ([]string, error) {
+        var users []string
+        for _, path := range paths {
+            userID, err := sessionUser(path, time.Now())
+            if err != nil {
+                return nil, err
+            }
+            users = append(users, userID)
+        }
+        return users, nil
+    }
+
+    for {
+        users, err := owners()
+        if err != nil {
+            return nil, err
+        }
+
+        locked := slices.Clone(paths)
+        for _, userID := range append(users, userIDs...) {
+            if userID != "" {
+                locked = append(locked, fs.indexPath(ctx, userID))
+            }
+        }
+
+        unlock, err := lockDirs(locked...)
+        if err != nil {
+            return nil, err
+        }
+
+        current, err := owners()
+        if err != nil {
+            unlock()
+            return nil, err
+        }
+        if slices.Equal(users, current) {
+            return unlock, nil
+        }
+        unlock()
+    }
+}
+
+// updateIndex adds a session to or removes it from the index of a user. The
+// caller holds the lock of the index file.
+func (fs *FileStore) updateIndex(ctx context.Context, userID, sessionID string, add bool) error {
+    if userID == "" {
+        return nil
+    }
+
+    path := fs.indexPath(ctx, userID)
+    index, err := readSessionFile(path, time.Now())
+    if err != nil && !errors.Is(err, ErrSessionInvalid) {
+        return err
+    }
+    index = newFileSession(index)
+
+    if add {
+        rel, err := filepath.Rel(fs.dir, fs.path(ctx, sessionID))
+        if err != nil {
+            return err
+        }
+        index.Values[sessionID] = rel
+    } else {
+        if _, ok := index.Values[sessionID]; !ok {
+            return nil
+        }
+        delete(index.Values, sessionID)
+    }
+
+    return writeSessionFile(path, index)
+}
+
+// indexMembers returns the session IDs of an index file with the paths of their files
+func (fs *FileStore) indexMembers(path string) (map[string]string, error) {
+    index, err := readSessionFile(path, time.Now())
+    if err != nil && !errors.Is(err, ErrSessionInvalid) {
+        return nil, err
+    }
+
+    members := make(map[string]string)
+    if index != nil {
+        for sessionID, rel := range index.Values {
+            members[sessionID] = filepath.Join(fs.dir, rel)
+        }
+    }
+    return members, nil
+}
+
+// BindUser stores the user ID in the session and adds the session to the user's index
+func (fs *FileStore) BindUser(ctx context.Context, sessionID, userID string) error {
+    path := fs.path(ctx, sessionID)
+
+    unlock, err := fs.lockWithIndexes(ctx, []string{path}, userID)
+    if err != nil {
+        return err
+    }
+    defer unlock()
+
+    session, err := readSessionFile(path, time.Now())
+    if err != nil && !errors.Is(err, ErrSessionInvalid) {
+        return err
+    }
+    session = newFileSession(session)
+
+    previous := session.Values[userIDField]
+    session.Values[userIDField] = userID
+    if err := writeSessionFile(path, session); err != nil {
+        return err
+    }
+
+    if previous != userID {
+        if err := fs.updateIndex(ctx, previous, sessionID, false); err != nil {
+            return err
+        }
+    }
+    return fs.updateIndex(ctx, userID, sessionID, true)
+}
+
+// ListUserSessions returns the live sessions of a user, pruning expired ones from the index
+func (fs *FileStore) ListUserSessions(ctx context.Context, userID string) ([]string, error) {
+    path := fs.indexPath(ctx, userID)
+
+    unlock, err := lockDirs(path)
+    if err != nil {
+        return nil, err
+    }
+    defer unlock()
+
+    members, err := fs.indexMembers(path)
+    if err != nil {
+        return nil, err
+    }
+
+    now := time.Now()
+    var live []string
+    pruned := false
+    for sessionID, sessionPath := range members {
+        owner, err := sessionUser(sessionPath, now)
+        if err != nil {
+            return nil, err
+        }
+        if owner == userID {
+            live = append(live, sessionID)
+        } else {
+            delete(members, sessionID)
+            pruned = true
+        }
+    }
+
+    if pruned {
+        if err := fs.writeIndex(path, members); err != nil {
+            return nil, err
+        }
+    }
+
+    return live, nil
+}
+
+// RevokeUserSessions deletes every session of a user
+func (fs *FileStore) RevokeUserSessions(ctx context.Context, userID string) error {
+    return fs.RevokeAllExcept(ctx, userID, "")
+}
+
+// RevokeAllExcept deletes every session of a user but currentSessionID. The
+// sessions are locked with the index, so none is bound or rotated meanwhile.
+func (fs *FileStore) RevokeAllExcept(ctx context.Context, userID, currentSessionID string) error {
+    path := fs.indexPath(ctx, userID)
+
+    for {
+        members, err := fs.indexMembers(path)
+        if err != nil {
+            return err
+        }
+
+        unlock, err := lockDirs(append(slices.Collect(maps.Values(members)), path)...)
+        if err != nil {
+            return err
+        }
+
+        locked, err := fs.indexMembers(path)
+        if err != nil {
+            unlock()
+            return err
+        }
+        if !maps.Equal(members, locked) {
+            unlock()
+            continue
+        }
+
+        err = fs.revoke(path, locked, currentSessionID)
+        unlock()
+        return err
+    }
+}
+
+// revoke deletes the sessions of an index but currentSessionID. The caller
+// holds the locks of the index and the sessions.
+func (fs *FileStore) revoke(path string, members map[string]string, currentSessionID string) error {
+    for sessionID, sessionPath := range members {
+        if sessionID == currentSessionID {
+            continue
+        }
+        if err := writeSessionFile(sessionPath, nil); err != nil {
+            return err
+        }
+        delete(members, sessionID)
+    }
+
+    return fs.writeIndex(path, members)
+}
+
+// writeIndex replaces an index file with members, given as by indexMembers
+func (fs *FileStore) writeIndex(path string, members map[string]string) error {
+    index := newFileSession(nil)
+    for sessionID, sessionPath := range members {
+        rel, err := filepath.Rel(fs.dir, sessionPath)
+        if err != nil {
+            return err
+        }
+        index.Values[sessionID] = rel
+    }
+    return writeSessionFile(path, index)
+}
+
+// pruneIndex removes the sessions that no longer exist from an index file
+func (fs *FileStore) pruneIndex(path string, now time.Time) {
+    unlock, err := lockDirs(path)
+    if err != nil {
+        return
+    }
+    defer unlock()
+
+    members, err := fs.indexMembers(path)
+    if err != nil {
+        return
+    }
+
+    pruned := false
+    for sessionID, sessionPath := range members {
+        if session, err := readSessionFile(sessionPath, now); err == nil && session == nil {
+            delete(members, sessionID)
+            pruned = true
+        }
+    }
+
+    if pruned {
+        _ = fs.writeIndex(path, members)
+    }
+}
+
+// DeleteExpired removes the files of expired sessions and temporary files
+// left behind by crashed writers, and prunes the user indexes. The sweeper
+// calls it periodically.
+func (fs *FileStore) DeleteExpired() error {
+    now := time.Now()
+    indexDir := filepath.Join(fs.dir, fileIndexDir) + string(filepath.Separator)
+
+    return filepath.WalkDir(fs.dir, func(path string, d os.DirEntry, err error) error {
+        if err != nil || d.IsDir() || d.Name() == fileLockName {
+            return nil
+        }
+
+        if strings.HasPrefix(d.Name(), fileTempPrefix) {
+            if info, err := d.Info(); err == nil && now.Sub(info.ModTime()) > staleTempAge {
+                _ = os.Remove(path)
+            }
+            return nil
+        }
+
+        if strings.HasPrefix(path, indexDir) {
+            fs.pruneIndex(path, now)
+            return nil
+        }
+
+        if session, err := readSessionFile(path, now); err != nil || session != nil {
+            return nil
+        }
+
+        // Check again under the lock, a writer may have revived the session
+        unlock, err := lockDirs(path)
+        if err != nil {
+            return nil
+        }
+        defer unlock()
+
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil
+        }
+        var session fileSession
+        if json.Unmarshal(data, &session) == nil && session.expired(now) {
+            _ = os.Remove(path)
+        }
+
+        return nil
+    })
+}
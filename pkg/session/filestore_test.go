@@ -0,0 +1,174 @@
+package sessionutils
+
+import (
+    "context"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestFileStoreConcurrentUpdates(t *testing.T) {
+    store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir()})
+    if err != nil {
+        t.Fatalf("NewFileStore() error = %v", err)
+    }
+    defer store.Close()
+
+    ctx := context.Background()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            err := store.Update(ctx, "abc", "count", func(old []byte) ([]byte, error) {
+                n, _ := strconv.Atoi(string(old))
+                return []byte(strconv.Itoa(n + 1)), nil
+            })
+            if err != nil {
+                t.Errorf("Update() error = %v", err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if count, err := store.HGet(ctx, "abc", "count"); err != nil || count != "20" {
+        t.Errorf("count = %q, %v; want %q", count, err, "20")
+    }
+}
+
+func TestFileStoreDeleteExpired(t *testing.T) {
+    dir := t.TempDir()
+    store, err := NewFileStore(FileStoreConfig{Dir: dir})
+    if err != nil {
+        t.Fatalf("NewFileStore() error = %v", err)
+    }
+    defer store.Close()
+
+    ctx := context.Background()
+    for _, id := range []string{"live", "expired"} {
+        if err := store.HSet(ctx, id, map[string]string{"a": "1"}); err != nil {
+            t.Fatalf("HSet() error = %v", err)
+        }
+    }
+    if err := store.Expire(ctx, "expired", time.Millisecond); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+
+    // A temporary file left behind by a crashed writer
+    stale := filepath.Join(filepath.Dir(store.path(ctx, "live")), fileTempPrefix+"crashed")
+    if err := os.WriteFile(stale, []byte("{}"), 0o600); err != nil {
+        t.Fatalf("WriteFile() error = %v", err)
+    }
+    old := time.Now().Add(-2 * staleTempAge)
+    if err := os.Chtimes(stale, old, old); err != nil {
+        t.Fatalf("Chtimes() error = %v", err)
+    }
+
+    time.Sleep(10 * time.Millisecond)
+
+    if err := store.DeleteExpired(); err != nil {
+        t.Fatalf("DeleteExpired() error = %v", err)
+    }
+
+    for path, want := range map[string]bool{
+        store.path(ctx, "live"):    true,
+        store.path(ctx, "expired"): false,
+        stale:                      false,
+    } {
+        if _, err := os.Stat(path); (err == nil) != want {
+            t.Errorf("%s exists = %v; want %v", filepath.Base(path), err == nil, want)
+        }
+    }
+}
+
+func TestFileStoreTenants(t *testing.T) {
+    store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir()})
+    if err != nil {
+        t.Fatalf("NewFileStore() error = %v", err)
+    }
+    defer store.Close()
+
+    acme := WithTenant(context.Background(), "acme")
+    if err := store.HSet(acme, "abc", map[string]string{"a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    if values, _ := store.HGetAll(WithTenant(context.Background(), "globex"), "abc"); len(values) != 0 {
+        t.Errorf("other tenant got %v; want no session", values)
+    }
+}
+
+func TestFileStoreCodec(t *testing.T) {
+    store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir(), Codec: BinaryCodec{}, CompressAbove: 16})
+    if err != nil {
+        t.Fatalf("NewFileStore() error = %v", err)
+    }
+    defer store.Close()
+
+    ctx := context.Background()
+
+    // Binary values are not valid UTF-8 and must survive the session file
+    for _, want := range []int64{-1, 1 << 40} {
+        if err := store.Save(ctx, "abc", "n", want); err != nil {
+            t.Fatalf("Save() error = %v", err)
+        }
+        var got int64
+        if err := store.LoadJSON(ctx, "abc", "n", &got); err != nil || got != want {
+            t.Errorf("LoadJSON() = %d, %v; want %d", got, err, want)
+        }
+    }
+
+    long := strings.Repeat("x", 100)
+    if err := store.Save(ctx, "abc", "s", long); err != nil {
+        t.Fatalf("Save() error = %v", err)
+    }
+    if raw, err := store.Load(ctx, "abc", "s"); err != nil || string(raw) != long {
+        t.Errorf("Load() = %q, %v; want the decompressed payload", raw, err)
+    }
+    if stored, _ := store.HGet(ctx, "abc", "s"); len(stored) >= len(long) {
+        t.Errorf("stored value has %d bytes; want it compressed", len(stored))
+    }
+}
+
+func TestFileStoreUserIndex(t *testing.T) {
+    store, err := NewFileStore(FileStoreConfig{Dir: t.TempDir()})
+    if err != nil {
+        t.Fatalf("NewFileStore() error = %v", err)
+    }
+    defer store.Close()
+
+    ctx := context.Background()
+    for _, id := range []string{"a", "b"} {
+        if err := store.BindUser(ctx, id, "alice"); err != nil {
+            t.Fatalf("BindUser() error = %v", err)
+        }
+    }
+
+    // Rotation moves the index entry along with the session
+    if _, err := store.RotateSession(ctx, "a", "c", RotateOptions{KeepData: true}); err != nil {
+        t.Fatalf("RotateSession() error = %v", err)
+    }
+    if members, _ := store.indexMembers(store.indexPath(ctx, "alice")); len(members) != 2 || members["a"] != "" || members["c"] == "" {
+        t.Errorf("index after rotation = %v; want b and c", members)
+    }
+
+    // The sweeper prunes expired sessions from the index and removes it once empty
+    for _, id := range []string{"b", "c"} {
+        if err := store.Expire(ctx, id, time.Millisecond); err != nil {
+            t.Fatalf("Expire() error = %v", err)
+        }
+    }
+    time.Sleep(10 * time.Millisecond)
+
+    if err := store.DeleteExpired(); err != nil {
+        t.Fatalf("DeleteExpired() error = %v", err)
+    }
+    if _, err := os.Stat(store.indexPath(ctx, "alice")); !os.IsNotExist(err) {
+        t.Errorf("index file exists after its sessions expired, err = %v", err)
+    }
+}
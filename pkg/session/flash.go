@@ -0,0 +1,102 @@
+package sessionutils
+
+import (
+    "errors"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// flashField holds the pending flash messages in the session
+const flashField = "_flash"
+
+// FlashCategory classifies a flash message
+type FlashCategory string
+
+const (
+    FlashSuccess FlashCategory = "success"
+    FlashError   FlashCategory = "error"
+    FlashInfo    FlashCategory = "info"
+)
+
+// flashMessages maps each category to its messages in the order they were added
+type flashMessages map[FlashCategory][]string
+
+// loadFlashes reads the pending flash messages of the current session
+func loadFlashes(c *fiber.Ctx) (flashMessages, error) {
+    flashes := flashMessages{}
+
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return nil, err
+    }
+
+    err = store.LoadJSON(ctx, sessionID, flashField, &flashes)
+    if err != nil && !errors.Is(err, ErrKeyNotFound) {
+        return nil, err
+    }
+
+    return flashes, nil
+}
+
+// saveFlashes writes the pending flash messages, removing the field once all were consumed
+func saveFlashes(c *fiber.Ctx, flashes flashMessages) error {
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return err
+    }
+
+    if len(flashes) == 0 {
+        return store.Delete(ctx, sessionID, flashField)
+    }
+
+    return store.Save(ctx, sessionID, flashField, flashes)
+}
+
+// AddFlash queues a one-time message for the next request, e.g. before a redirect
+func AddFlash(c *fiber.Ctx, category FlashCategory, message string) error {
+    flashes, err := loadFlashes(c)
+    if err != nil {
+        return err
+    }
+
+    flashes[category] = append(flashes[category], message)
+
+    return saveFlashes(c, flashes)
+}
+
+// Flashes returns and consumes the messages of a category
+func Flashes(c *fiber.Ctx, category FlashCategory) ([]string, error) {
+    flashes, err := loadFlashes(c)
+    if err != nil {
+        return nil, err
+    }
+
+    messages, ok := flashes[category]
+    if !ok {
+        return nil, nil
+    }
+    delete(flashes, category)
+
+    if err := saveFlashes(c, flashes); err != nil {
+        return nil, err
+    }
+
+    return messages, nil
+}
+
+// AllFlashes returns and consumes the messages of every category
+func AllFlashes(c *fiber.Ctx) (map[FlashCategory][]string, error) {
+    flashes, err := loadFlashes(c)
+    if err != nil {
+        return nil, err
+    }
+    if len(flashes) == 0 {
+        return flashes, nil
+    }
+
+    if err := saveFlashes(c, flashMessages{}); err != nil {
+        return nil, err
+    }
+
+    return flashes, nil
+}
@@ -0,0 +1,62 @@
+package sessionutils
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestFlashes(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Post("/save", func(c *fiber.Ctx) error {
+        if err := AddFlash(c, FlashSuccess, "saved"); err != nil {
+            return err
+        }
+        if err := AddFlash(c, FlashSuccess, "notified"); err != nil {
+            return err
+        }
+        if err := AddFlash(c, FlashInfo, "hello"); err != nil {
+            return err
+        }
+        return c.Redirect("/")
+    })
+    app.Get("/success", func(c *fiber.Ctx) error {
+        messages, err := Flashes(c, FlashSuccess)
+        if err != nil {
+            return err
+        }
+        return c.SendString(strings.Join(messages, ","))
+    })
+    app.Get("/all", func(c *fiber.Ctx) error {
+        flashes, err := AllFlashes(c)
+        if err != nil {
+            return err
+        }
+        return c.SendString(strings.Join(flashes[FlashSuccess], ",") + "|" + strings.Join(flashes[FlashInfo], ","))
+    })
+
+    resp, _ := doRequest(t, app, "POST", "/save", nil)
+    cookies := []*http.Cookie{sessionCookie(resp, "sid")}
+
+    if _, body := doRequest(t, app, "GET", "/success", cookies); body != "saved,notified" {
+        t.Errorf("Flashes(success) = %q; want %q", body, "saved,notified")
+    }
+    if _, body := doRequest(t, app, "GET", "/all", cookies); body != "|hello" {
+        t.Errorf("AllFlashes() = %q; want %q", body, "|hello")
+    }
+    if _, body := doRequest(t, app, "GET", "/all", cookies); body != "|" {
+        t.Errorf("AllFlashes() after consuming = %q; want %q", body, "|")
+    }
+}
@@ -0,0 +1,84 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+// SessionHooks are callbacks for session lifecycle events, e.g. for auditing
+// and metrics. The context is the one used for the request's store calls.
+type SessionHooks struct {
+    OnCreate  func(ctx context.Context, sessionID string) error
+    OnRotate  func(ctx context.Context, oldSessionID, newSessionID string) error
+    OnRefresh func(ctx context.Context, sessionID string) error // TTL extended, see RefreshThreshold
+    OnExpire  func(ctx context.Context, sessionID string) error // idle or absolute timeout reached
+    OnDestroy func(ctx context.Context, sessionID string) error
+}
+
+// hookError marks an error returned by a fatal hook, so it reaches the
+// caller as is instead of being turned into a generic server error
+type hookError struct {
+    err error
+}
+
+func (e *hookError) Error() string { return e.err.Error() }
+func (e *hookError) Unwrap() error { return e.err }
+
+// hookResult applies the configured error policy to the result of a hook
+func (config SessionMiddlewareConfig) hookResult(ctx context.Context, event string, err error) error {
+    if err == nil {
+        return nil
+    }
+    if config.HookErrorsFatal {
+        return &hookError{err: err}
+    }
+
+    logx.Warn(ctx, "session %s hook failed: %v", event, err)
+    return nil
+}
+
+func (config SessionMiddlewareConfig) fireCreate(ctx context.Context, sessionID string) error {
+    if config.Hooks.OnCreate == nil {
+        return nil
+    }
+    return config.hookResult(ctx, "create", config.Hooks.OnCreate(ctx, sessionID))
+}
+
+func (config SessionMiddlewareConfig) fireRotate(ctx context.Context, oldSessionID, newSessionID string) error {
+    if config.Hooks.OnRotate == nil {
+        return nil
+    }
+    return config.hookResult(ctx, "rotate", config.Hooks.OnRotate(ctx, oldSessionID, newSessionID))
+}
+
+func (config SessionMiddlewareConfig) fireRefresh(ctx context.Context, sessionID string) error {
+    if config.Hooks.OnRefresh == nil {
+        return nil
+    }
+    return config.hookResult(ctx, "refresh", config.Hooks.OnRefresh(ctx, sessionID))
+}
+
+func (config SessionMiddlewareConfig) fireExpire(ctx context.Context, sessionID string) error {
+    if config.Hooks.OnExpire == nil {
+        return nil
+    }
+    return config.hookResult(ctx, "expire", config.Hooks.OnExpire(ctx, sessionID))
+}
+
+func (config SessionMiddlewareConfig) fireDestroy(ctx context.Context, sessionID string) error {
+    if config.Hooks.OnDestroy == nil {
+        return nil
+    }
+    return config.hookResult(ctx, "destroy", config.Hooks.OnDestroy(ctx, sessionID))
+}
+
+// unwrapHookError returns the error of a fatal hook as the hook returned it
+func unwrapHookError(err error) error {
+    var hookErr *hookError
+    if errors.As(err, &hookErr) {
+        return hookErr.err
+    }
+    return err
+}
@@ -0,0 +1,109 @@
+package sessionutils
+
+import (
+    "context"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// pendingSessionKey is the Fiber locals key of a lazy session that is not stored yet
+const pendingSessionKey = "session_pending"
+
+// pendingSession tracks whether a lazy session was stored during the request
+type pendingSession struct {
+    stored bool
+}
+
+// pendingSessionFrom returns the pending lazy session of the request, if any
+func pendingSessionFrom(c *fiber.Ctx) *pendingSession {
+    pending, _ := c.Locals(pendingSessionKey).(*pendingSession)
+    return pending
+}
+
+// store stores the lazy session before its first write, so its data never
+// exists without created_at and a TTL, even if the request fails later
+func (pending *pendingSession) store(ctx context.Context, config SessionMiddlewareConfig, sessionID string) error {
+    if pending.stored {
+        return nil
+    }
+    if err := initSession(ctx, config, sessionID); err != nil {
+        return err
+    }
+    pending.stored = true
+    return nil
+}
+
+// commitPendingSession sets the cookie of a lazy session that was stored.
+// A session nothing was written to costs no store round trip.
+func commitPendingSession(ctx context.Context, c *fiber.Ctx, config SessionMiddlewareConfig) error {
+    pending := pendingSessionFrom(c)
+    if pending == nil || !pending.stored {
+        return nil
+    }
+
+    sessionID, err := GetSessionID(c)
+    if err != nil {
+        return nil
+    }
+    writeSessionID(c, config, sessionID)
+
+    c.Locals(pendingSessionKey, nil)
+
+    return nil
+}
+
+// trackingStore wraps the store of a pending lazy session and stores the
+// session before the first write
+type trackingStore struct {
+    Store
+    config  SessionMiddlewareConfig
+    pending *pendingSession
+}
+
+// Save saves a Go value into the session
+func (ts *trackingStore) Save(ctx context.Context, sessionID, key string, value any) error {
+    if err := ts.pending.store(ctx, ts.config, sessionID); err != nil {
+        return err
+    }
+    return ts.Store.Save(ctx, sessionID, key, value)
+}
+
+// HSet sets multiple fields in the session
+func (ts *trackingStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    if err := ts.pending.store(ctx, ts.config, sessionID); err != nil {
+        return err
+    }
+    return ts.Store.HSet(ctx, sessionID, values)
+}
+
+// Update replaces the raw value of a session key
+func (ts *trackingStore) Update(ctx context.Context, sessionID, key string, fn func(old []byte) ([]byte, error)) error {
+    updater, ok := ts.Store.(Updater)
+    if !ok {
+        return ErrUpdateUnsupported
+    }
+    if err := ts.pending.store(ctx, ts.config, sessionID); err != nil {
+        return err
+    }
+    return updater.Update(ctx, sessionID, key, fn)
+}
+
+// UpdateSession changes several fields of the session at once
+func (ts *trackingStore) UpdateSession(ctx context.Context, sessionID string, fn func(values map[string]string) error) error {
+    updater, ok := ts.Store.(Updater)
+    if !ok {
+        return ErrUpdateUnsupported
+    }
+    if err := ts.pending.store(ctx, ts.config, sessionID); err != nil {
+        return err
+    }
+    return updater.UpdateSession(ctx, sessionID, fn)
+}
+
+func (ts *trackingStore) encodeValue(value any) ([]byte, error) {
+    return encodeFor(ts.Store, value)
+}
+
+func (ts *trackingStore) decodeValue(data []byte, dest any) error {
+    return decodeFor(ts.Store, data, dest)
+}
@@ -0,0 +1,176 @@
+package sessionutils
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+    "time"
+)
+
+// Bookkeeping fields stored in every session hash, as unix timestamps
+const (
+    createdAtField  = "created_at"  // when the current session ID was issued, reset on rotation
+    startedAtField  = "started_at"  // when the session was started, kept across rotations
+    lastAccessField = "last_access" // last request seen, only maintained with an IdleTimeout
+)
+
+// sessionTimes holds the timestamps used to enforce session lifetimes
+type sessionTimes struct {
+    createdAt  time.Time
+    startedAt  time.Time
+    lastAccess time.Time
+}
+
+// sessionState is what the middleware learns about an existing session
+type sessionState struct {
+    times     sessionTimes
+    foreign   bool // the session belongs to another tenant and was left untouched
+    refreshed bool // the TTL was refreshed
+}
+
+// touchSession reads the bookkeeping fields of a session, updates its last
+// access and refreshes its TTL as the refresh policy allows, in one round trip
+// for stores implementing Toucher. It returns ErrKeyNotFound if the session
+// does not exist. Sessions created before started_at and last_access were
+// introduced fall back to created_at.
+func (config SessionMiddlewareConfig) touchSession(ctx context.Context, sessionID string, now time.Time) (sessionState, error) {
+    var state sessionState
+
+    tenant := TenantFromContext(ctx)
+    opts := TouchOptions{
+        Fields:   []string{createdAtField, startedAtField, lastAccessField},
+        Required: createdAtField,
+    }
+    if tenant != "" {
+        // Sessions of other tenants are treated as unknown, which also
+        // isolates tenants in stores that do not namespace their keys
+        opts.Match = map[string]string{tenantField: tenant}
+    }
+    if config.IdleTimeout > 0 {
+        opts.Set = map[string]string{lastAccessField: strconv.FormatInt(now.Unix(), 10)}
+    }
+    opts.TTL, opts.RefreshBelow = config.refreshPolicy(tenant+":"+sessionID, now)
+
+    result, err := touch(ctx, config.Store, sessionID, opts)
+    if err != nil {
+        return state, err
+    }
+    if !result.Matched {
+        state.foreign = true
+        return state, nil
+    }
+
+    createdAt, ok := parseUnix(result.Values[createdAtField])
+    if !ok {
+        return state, invalid("invalid created_at %q", result.Values[createdAtField])
+    }
+    state.times = sessionTimes{createdAt: createdAt, startedAt: createdAt, lastAccess: createdAt}
+
+    if t, ok := parseUnix(result.Values[startedAtField]); ok {
+        state.times.startedAt = t
+    }
+    if t, ok := parseUnix(result.Values[lastAccessField]); ok {
+        state.times.lastAccess = t
+    }
+
+    if result.Refreshed {
+        state.refreshed = true
+        if config.touches != nil {
+            config.touches.record(tenant+":"+sessionID, now, config.RefreshInterval)
+        }
+    }
+
+    return state, nil
+}
+
+// validateRefresh rejects a RefreshInterval that lets a session in use
+// expire: its TTL may go that long without a refresh, so it has to outlast
+// both the interval and an idle period
+func (config SessionMiddlewareConfig) validateRefresh() error {
+    if config.RefreshInterval <= 0 {
+        return nil
+    }
+    if config.RefreshInterval >= config.SessionDuration {
+        return fmt.Errorf("RefreshInterval %s must be shorter than SessionDuration %s", config.RefreshInterval, config.SessionDuration)
+    }
+    if config.IdleTimeout > 0 && config.RefreshInterval >= config.IdleTimeout {
+        return fmt.Errorf("RefreshInterval %s must be shorter than IdleTimeout %s", config.RefreshInterval, config.IdleTimeout)
+    }
+    return nil
+}
+
+// refreshPolicy returns the TTL to set on an existing session and the
+// remaining TTL below which to set it. Without throttling the TTL is always
+// refreshed. Otherwise it is refreshed when RefreshInterval passed since this
+// process last did it, or when less than RefreshThreshold of it remains.
+func (config SessionMiddlewareConfig) refreshPolicy(key string, now time.Time) (ttl, below time.Duration) {
+    if config.RefreshThreshold <= 0 && config.RefreshInterval <= 0 {
+        return config.SessionDuration, 0
+    }
+    if config.RefreshInterval > 0 && (config.touches == nil || config.touches.due(key, now, config.RefreshInterval)) {
+        return config.SessionDuration, 0
+    }
+    if config.RefreshThreshold > 0 {
+        return config.SessionDuration, time.Duration(float64(config.SessionDuration) * config.RefreshThreshold)
+    }
+    return 0, 0
+}
+
+// expired reports whether the session reached its idle or absolute limit
+func (t sessionTimes) expired(config SessionMiddlewareConfig, now time.Time) bool {
+    if config.AbsoluteTimeout > 0 && now.Sub(t.startedAt) > config.AbsoluteTimeout {
+        return true
+    }
+    if config.IdleTimeout > 0 && now.Sub(t.lastAccess) > config.IdleTimeout {
+        return true
+    }
+    return false
+}
+
+// sessionTTL returns the store TTL for a session: SessionDuration, but never
+// beyond the end of the absolute lifetime
+func (config SessionMiddlewareConfig) sessionTTL(times sessionTimes, now time.Time) time.Duration {
+    ttl := config.SessionDuration
+
+    if config.AbsoluteTimeout > 0 && !times.startedAt.IsZero() {
+        if remaining := times.startedAt.Add(config.AbsoluteTimeout).Sub(now); remaining < ttl {
+            ttl = remaining
+        }
+    }
+
+    return ttl
+}
+
+// initSession stores the bookkeeping fields of a new session, sets its TTL and fires OnCreate
+func initSession(ctx context.Context, config SessionMiddlewareConfig, sessionID string) error {
+    now := strconv.FormatInt(time.Now().Unix(), 10)
+
+    fields := map[string]string{
+        createdAtField: now,
+        startedAtField: now,
+    }
+    if config.IdleTimeout > 0 {
+        fields[lastAccessField] = now
+    }
+    if tenant := TenantFromContext(ctx); tenant != "" {
+        fields[tenantField] = tenant
+    }
+
+    if err := config.Store.HSet(ctx, sessionID, fields); err != nil {
+        return err
+    }
+
+    if err := config.Store.Expire(ctx, sessionID, config.SessionDuration); err != nil {
+        return err
+    }
+
+    return config.fireCreate(ctx, sessionID)
+}
+
+func parseUnix(value string) (time.Time, bool) {
+    unix, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        return time.Time{}, false
+    }
+    return time.Unix(unix, 0), true
+}
@@ -0,0 +1,620 @@
+package sessionutils
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "slices"
+    "sync"
+    "time"
+)
+
+// memoryEntry is a single session hash kept by MemoryStore
+type memoryEntry struct {
+    values    map[string]string
+    expiresAt time.Time // zero value means no expiry
+    version   uint64    // bumped on every change, used by Update to detect conflicts
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+    return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// MemoryStore is an in-process Store implementation. It mirrors the
+// semantics of the Redis-backed SessionManager, honors TTLs set via Expire
+// and is safe for concurrent use. It is meant for tests and single-node
+// deployments that do not want to run Redis.
+type MemoryStore struct {
+    mu       sync.RWMutex
+    sessions map[string]*memoryEntry
+    users    map[string]map[string]struct{} // user ID -> session IDs
+    remember map[string]*rememberEntry      // tenant namespace and selector -> series
+
+    stop     chan struct{}
+    stopOnce sync.Once
+}
+
+// NewMemoryStore creates a new in-memory store. If cleanupInterval is
+// positive, expired sessions are removed in the background at that interval
+// until Close is called. Expired sessions are never returned regardless.
+func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+    ms := &MemoryStore{
+        sessions: make(map[string]*memoryEntry),
+        users:    make(map[string]map[string]struct{}),
+        remember: make(map[string]*rememberEntry),
+        stop:     make(chan struct{}),
+    }
+
+    if cleanupInterval > 0 {
+        go ms.cleanupLoop(cleanupInterval)
+    }
+
+    return ms
+}
+
+// Close stops the background cleanup goroutine
+func (ms *MemoryStore) Close() {
+    ms.stopOnce.Do(func() {
+        close(ms.stop)
+    })
+}
+
+func (ms *MemoryStore) cleanupLoop(interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ms.stop:
+            return
+        case <-ticker.C:
+            ms.deleteExpired()
+        }
+    }
+}
+
+// deleteExpired removes every expired session
+func (ms *MemoryStore) deleteExpired() {
+    now := time.Now()
+
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    for id, entry := range ms.sessions {
+        if entry.expired(now) {
+            ms.deleteSession(id)
+        }
+    }
+    for key, series := range ms.remember {
+        if !now.Before(series.expiresAt) {
+            delete(ms.remember, key)
+        }
+    }
+}
+
+// entry returns the live entry for a session; the caller must hold ms.mu
+func (ms *MemoryStore) entry(sessionID string) (*memoryEntry, bool) {
+    entry, ok := ms.sessions[sessionID]
+    if !ok || entry.expired(time.Now()) {
+        return nil, false
+    }
+    return entry, true
+}
+
+// entryForWrite returns the live entry for a session, creating it if needed.
+// An expired entry is replaced, just like Redis treats an expired key as absent.
+// The caller must hold ms.mu for writing.
+func (ms *MemoryStore) entryForWrite(sessionID string) *memoryEntry {
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        entry = &memoryEntry{values: make(map[string]string)}
+        ms.sessions[sessionID] = entry
+    }
+    return entry
+}
+
+// Save saves a Go value into the session
+func (ms *MemoryStore) Save(ctx context.Context, sessionID, key string, value any) error {
+    jsonValue, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Errorf("failed to marshal session value: %w", err)
+    }
+
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    entry := ms.entryForWrite(sessionID)
+    entry.values[key] = string(jsonValue)
+    entry.version++
+
+    return nil
+}
+
+// Load loads a raw value (as []byte) from the session
+func (ms *MemoryStore) Load(ctx context.Context, sessionID, key string) ([]byte, error) {
+    ms.mu.RLock()
+    defer ms.mu.RUnlock()
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return nil, &notFoundError{key: key}
+    }
+
+    data, ok := entry.values[key]
+    if !ok {
+        return nil, &notFoundError{key: key}
+    }
+
+    return []byte(data), nil
+}
+
+// LoadJSON unmarshals a Go value from the session
+func (ms *MemoryStore) LoadJSON(ctx context.Context, sessionID, key string, dest any) error {
+    raw, err := ms.Load(ctx, sessionID, key)
+    if err != nil {
+        return err
+    }
+
+    if err := json.Unmarshal(raw, dest); err != nil {
+        return fmt.Errorf("failed to unmarshal session value: %w", err)
+    }
+
+    return nil
+}
+
+// Delete deletes a key from the session
+func (ms *MemoryStore) Delete(ctx context.Context, sessionID, key string) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return nil
+    }
+
+    delete(entry.values, key)
+    entry.version++
+
+    // Redis removes a hash once its last field is gone
+    if len(entry.values) == 0 {
+        delete(ms.sessions, sessionID)
+    }
+
+    return nil
+}
+
+// Clear deletes the entire session
+func (ms *MemoryStore) Clear(ctx context.Context, sessionID string) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    ms.deleteSession(sessionID)
+
+    return nil
+}
+
+// deleteSession removes a session and its user index entry; the caller must hold ms.mu
+func (ms *MemoryStore) deleteSession(sessionID string) {
+    if entry, ok := ms.sessions[sessionID]; ok {
+        if userID, ok := entry.values[userIDField]; ok {
+            ms.unindex(userID, sessionID)
+        }
+    }
+    delete(ms.sessions, sessionID)
+}
+
+// unindex removes a session from a user's index; the caller must hold ms.mu
+func (ms *MemoryStore) unindex(userID, sessionID string) {
+    delete(ms.users[userID], sessionID)
+    if len(ms.users[userID]) == 0 {
+        delete(ms.users, userID)
+    }
+}
+
+// HSet sets multiple fields in the session
+func (ms *MemoryStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    if len(values) == 0 {
+        return nil
+    }
+
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    entry := ms.entryForWrite(sessionID)
+    for k, v := range values {
+        entry.values[k] = v
+    }
+    entry.version++
+
+    return nil
+}
+
+// HGetAll gets all fields from the session
+func (ms *MemoryStore) HGetAll(ctx context.Context, sessionID string) (map[string]string, error) {
+    ms.mu.RLock()
+    defer ms.mu.RUnlock()
+
+    result := make(map[string]string)
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return result, nil
+    }
+
+    for k, v := range entry.values {
+        result[k] = v
+    }
+
+    return result, nil
+}
+
+// HGet gets a single field from the session
+func (ms *MemoryStore) HGet(ctx context.Context, sessionID, key string) (string, error) {
+    ms.mu.RLock()
+    defer ms.mu.RUnlock()
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return "", &notFoundError{key: key}
+    }
+
+    value, ok := entry.values[key]
+    if !ok {
+        return "", &notFoundError{key: key}
+    }
+
+    return value, nil
+}
+
+// Expire sets an expiration time for the session
+func (ms *MemoryStore) Expire(ctx context.Context, sessionID string, expiration time.Duration) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return nil
+    }
+
+    // A non-positive TTL deletes the key, as in Redis
+    if expiration <= 0 {
+        ms.deleteSession(sessionID)
+        return nil
+    }
+
+    entry.expiresAt = time.Now().Add(expiration)
+    entry.version++
+
+    return nil
+}
+
+// RotateSession atomically moves a session to a new ID
+func (ms *MemoryStore) RotateSession(ctx context.Context, oldSessionID, newSessionID string, opts RotateOptions) (string, error) {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    values := make(map[string]string)
+
+    if opts.KeepData {
+        if old, ok := ms.entry(oldSessionID); ok {
+            if target, ok := old.values[rotatedToField]; ok {
+                return target, nil
+            }
+            for k, v := range old.values {
+                values[k] = v
+            }
+        }
+    }
+
+    for k, v := range opts.Fields {
+        values[k] = v
+    }
+
+    now := time.Now()
+
+    ms.deleteSession(oldSessionID)
+
+    if len(values) > 0 {
+        entry := &memoryEntry{values: values}
+        if opts.TTL > 0 {
+            entry.expiresAt = now.Add(opts.TTL)
+        }
+        ms.sessions[newSessionID] = entry
+
+        if userID, ok := values[userIDField]; ok {
+            ms.index(userID, newSessionID)
+        }
+    }
+
+    if opts.Grace > 0 {
+        ms.sessions[oldSessionID] = &memoryEntry{
+            values:    map[string]string{rotatedToField: newSessionID},
+            expiresAt: now.Add(opts.Grace),
+        }
+    }
+
+    return newSessionID, nil
+}
+
+// index adds a session to a user's index; the caller must hold ms.mu
+func (ms *MemoryStore) index(userID, sessionID string) {
+    if ms.users[userID] == nil {
+        ms.users[userID] = make(map[string]struct{})
+    }
+    ms.users[userID][sessionID] = struct{}{}
+}
+
+// BindUser binds a session to a user and adds it to the user's index
+func (ms *MemoryStore) BindUser(ctx context.Context, sessionID, userID string) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    entry := ms.entryForWrite(sessionID)
+    if previous, ok := entry.values[userIDField]; ok && previous != userID {
+        ms.unindex(previous, sessionID)
+    }
+    entry.values[userIDField] = userID
+    entry.version++
+    ms.index(userID, sessionID)
+
+    return nil
+}
+
+// ListUserSessions returns the live sessions of a user, pruning expired ones from the index
+func (ms *MemoryStore) ListUserSessions(ctx context.Context, userID string) ([]string, error) {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    var live []string
+    for sessionID := range ms.users[userID] {
+        if entry, ok := ms.entry(sessionID); ok && entry.values[userIDField] == userID {
+            live = append(live, sessionID)
+        } else {
+            ms.unindex(userID, sessionID)
+        }
+    }
+
+    return live, nil
+}
+
+// RevokeUserSessions deletes every session of a user
+func (ms *MemoryStore) RevokeUserSessions(ctx context.Context, userID string) error {
+    return ms.RevokeAllExcept(ctx, userID, "")
+}
+
+// RevokeAllExcept deletes every session of a user but currentSessionID
+func (ms *MemoryStore) RevokeAllExcept(ctx context.Context, userID, currentSessionID string) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    for sessionID := range ms.users[userID] {
+        if sessionID != currentSessionID {
+            delete(ms.sessions, sessionID)
+            ms.unindex(userID, sessionID)
+        }
+    }
+
+    return nil
+}
+
+// snapshot returns the entry of a session, its version and a copy of its
+// values. The entry is nil if the session does not exist.
+func (ms *MemoryStore) snapshot(sessionID string) (*memoryEntry, uint64, map[string]string) {
+    ms.mu.RLock()
+    defer ms.mu.RUnlock()
+
+    values := make(map[string]string)
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return nil, 0, values
+    }
+
+    for k, v := range entry.values {
+        values[k] = v
+    }
+
+    return entry, entry.version, values
+}
+
+// unchanged reports whether a session is still at the snapshot taken
+// earlier; the caller must hold ms.mu
+func (ms *MemoryStore) unchanged(sessionID string, entry *memoryEntry, version uint64) bool {
+    current, ok := ms.entry(sessionID)
+    if !ok {
+        return entry == nil
+    }
+    return current == entry && current.version == version
+}
+
+// Update replaces the raw value of a session key, retrying when the session
+// changes while fn runs
+func (ms *MemoryStore) Update(ctx context.Context, sessionID, key string, fn func(old []byte) ([]byte, error)) error {
+    return ms.UpdateSession(ctx, sessionID, func(values map[string]string) error {
+        var old []byte
+        if v, ok := values[key]; ok {
+            old = []byte(v)
+        }
+
+        value, err := fn(old)
+        if err != nil {
+            return err
+        }
+
+        if value == nil {
+            delete(values, key)
+        } else {
+            values[key] = string(value)
+        }
+        return nil
+    })
+}
+
+// UpdateSession changes several fields of a session at once, retrying when
+// the session changes while fn runs
+func (ms *MemoryStore) UpdateSession(ctx context.Context, sessionID string, fn func(values map[string]string) error) error {
+    for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+        entry, version, old := ms.snapshot(sessionID)
+
+        values := make(map[string]string, len(old))
+        for k, v := range old {
+            values[k] = v
+        }
+        if err := fn(values); err != nil {
+            return err
+        }
+
+        set, del := diffSession(old, values)
+
+        ms.mu.Lock()
+        if !ms.unchanged(sessionID, entry, version) {
+            ms.mu.Unlock()
+            continue
+        }
+        if len(set) > 0 || len(del) > 0 {
+            ms.applyUpdate(sessionID, set, del)
+        }
+        ms.mu.Unlock()
+
+        return nil
+    }
+
+    return ErrUpdateConflict
+}
+
+// applyUpdate sets and deletes session fields; the caller must hold ms.mu
+func (ms *MemoryStore) applyUpdate(sessionID string, set map[string]string, del []string) {
+    entry := ms.entryForWrite(sessionID)
+
+    for _, k := range del {
+        delete(entry.values, k)
+    }
+    for k, v := range set {
+        entry.values[k] = v
+    }
+    entry.version++
+
+    // Redis removes a hash once its last field is gone
+    if len(entry.values) == 0 {
+        delete(ms.sessions, sessionID)
+    }
+}
+
+// Touch reads, writes and refreshes a session in one step
+func (ms *MemoryStore) Touch(ctx context.Context, sessionID string, opts TouchOptions) (TouchResult, error) {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    entry, ok := ms.entry(sessionID)
+    if !ok {
+        return TouchResult{}, &notFoundError{key: opts.Required}
+    }
+    if _, ok := entry.values[opts.Required]; !ok {
+        return TouchResult{}, &notFoundError{key: opts.Required}
+    }
+
+    result := TouchResult{Values: make(map[string]string)}
+    for _, field := range opts.Fields {
+        if value, ok := entry.values[field]; ok {
+            result.Values[field] = value
+        }
+    }
+    for k, v := range opts.Match {
+        if entry.values[k] != v {
+            return result, nil
+        }
+    }
+    result.Matched = true
+
+    for k, v := range opts.Set {
+        entry.values[k] = v
+    }
+
+    now := time.Now()
+    if opts.TTL > 0 {
+        // Like PTTL, a session without expiry counts as below any threshold
+        remaining := entry.expiresAt.Sub(now)
+        if opts.RefreshBelow <= 0 || entry.expiresAt.IsZero() || remaining < opts.RefreshBelow {
+            entry.expiresAt = now.Add(opts.TTL)
+            result.Refreshed = true
+        }
+    }
+    if len(opts.Set) > 0 || result.Refreshed {
+        entry.version++
+    }
+
+    return result, nil
+}
+
+// rememberEntry is a remember-me series kept by MemoryStore
+type rememberEntry struct {
+    userID    string
+    validator string
+    history   []string // old validators, newest first
+    rotatedAt time.Time
+    expiresAt time.Time
+}
+
+// rememberKey returns the key of a remember-me series
+func rememberKey(ctx context.Context, selector string) string {
+    return keyNamespace("", TenantFromContext(ctx)) + selector
+}
+
+// CreateSeries stores a new remember-me series
+func (ms *MemoryStore) CreateSeries(ctx context.Context, selector, userID, validatorHash string, ttl time.Duration) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    ms.remember[rememberKey(ctx, selector)] = &rememberEntry{
+        userID:    userID,
+        validator: validatorHash,
+        expiresAt: time.Now().Add(ttl),
+    }
+
+    return nil
+}
+
+// ConsumeSeries checks and rotates the validator of a remember-me series
+func (ms *MemoryStore) ConsumeSeries(ctx context.Context, selector, validatorHash, newValidatorHash string, ttl, grace time.Duration) (string, bool, error) {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    key := rememberKey(ctx, selector)
+    now := time.Now()
+
+    series, ok := ms.remember[key]
+    if !ok || !now.Before(series.expiresAt) {
+        return "", false, &notFoundError{key: rememberKeyPrefix + selector}
+    }
+
+    switch {
+    case series.validator == validatorHash:
+        series.history = append([]string{series.validator}, series.history...)
+        if len(series.history) > rememberHistory {
+            series.history = series.history[:rememberHistory]
+        }
+        series.validator = newValidatorHash
+        series.rotatedAt = now
+        series.expiresAt = now.Add(ttl)
+        return series.userID, true, nil
+
+    case len(series.history) > 0 && series.history[0] == validatorHash && now.Sub(series.rotatedAt) < grace:
+        return series.userID, false, nil
+
+    case slices.Contains(series.history, validatorHash):
+        delete(ms.remember, key)
+        return series.userID, false, ErrRememberTokenStolen
+    }
+
+    return series.userID, false, ErrRememberTokenInvalid
+}
+
+// DeleteSeries deletes a remember-me series
+func (ms *MemoryStore) DeleteSeries(ctx context.Context, selector string) error {
+    ms.mu.Lock()
+    defer ms.mu.Unlock()
+
+    delete(ms.remember, rememberKey(ctx, selector))
+
+    return nil
+}
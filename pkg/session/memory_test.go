@@ -0,0 +1,195 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "net/http/httptest"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestMemoryStoreExpire(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(10 * time.Millisecond)
+    defer store.Close()
+
+    if err := store.HSet(ctx, "abc", map[string]string{"user": "alice"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Expire(ctx, "abc", 50*time.Millisecond); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+
+    if value, err := store.HGet(ctx, "abc", "user"); err != nil || value != "alice" {
+        t.Fatalf("HGet() = %q, %v; want %q, nil", value, err, "alice")
+    }
+
+    time.Sleep(100 * time.Millisecond)
+
+    if _, err := store.HGet(ctx, "abc", "user"); err == nil {
+        t.Errorf("HGet() after expiry returned no error")
+    }
+
+    store.mu.RLock()
+    n := len(store.sessions)
+    store.mu.RUnlock()
+    if n != 0 {
+        t.Errorf("cleanup left %d sessions behind; want 0", n)
+    }
+}
+
+func TestMemoryStoreWithMiddleware(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Get("/", func(c *fiber.Ctx) error {
+        return c.SendString(MustGetSessionID(c))
+    })
+
+    resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+    if err != nil {
+        t.Fatalf("app.Test() error = %v", err)
+    }
+
+    var sessionID string
+    for _, cookie := range resp.Cookies() {
+        if cookie.Name == "sid" {
+            sessionID = cookie.Value
+        }
+    }
+    if sessionID == "" {
+        t.Fatalf("no session cookie was set")
+    }
+
+    if _, err := store.HGet(context.Background(), sessionID, "created_at"); err != nil {
+        t.Errorf("created_at was not stored: %v", err)
+    }
+}
+
+func TestMemoryStoreUserIndex(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    for _, id := range []string{"a", "b", "c"} {
+        if err := store.BindUser(ctx, id, "alice"); err != nil {
+            t.Fatalf("BindUser(%q) error = %v", id, err)
+        }
+    }
+
+    // Rotation moves the index entry along with the session
+    if _, err := store.RotateSession(ctx, "c", "d", RotateOptions{KeepData: true}); err != nil {
+        t.Fatalf("RotateSession() error = %v", err)
+    }
+    // An expired session disappears from the listing
+    if err := store.Expire(ctx, "b", time.Millisecond); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+    time.Sleep(5 * time.Millisecond)
+
+    sessions, err := store.ListUserSessions(ctx, "alice")
+    if err != nil {
+        t.Fatalf("ListUserSessions() error = %v", err)
+    }
+    sort.Strings(sessions)
+    if strings.Join(sessions, ",") != "a,d" {
+        t.Errorf("ListUserSessions() = %v; want [a d]", sessions)
+    }
+
+    if err := store.RevokeAllExcept(ctx, "alice", "d"); err != nil {
+        t.Fatalf("RevokeAllExcept() error = %v", err)
+    }
+    if sessions, _ := store.ListUserSessions(ctx, "alice"); len(sessions) != 1 || sessions[0] != "d" {
+        t.Errorf("ListUserSessions() after RevokeAllExcept() = %v; want [d]", sessions)
+    }
+    if _, err := store.HGet(ctx, "a", userIDField); err == nil {
+        t.Errorf("revoked session still exists")
+    }
+
+    if err := store.RevokeUserSessions(ctx, "alice"); err != nil {
+        t.Fatalf("RevokeUserSessions() error = %v", err)
+    }
+    if sessions, _ := store.ListUserSessions(ctx, "alice"); len(sessions) != 0 {
+        t.Errorf("ListUserSessions() after RevokeUserSessions() = %v; want []", sessions)
+    }
+}
+
+func TestMemoryStoreUpdate(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    increment := func(old []byte) ([]byte, error) {
+        n, _ := strconv.Atoi(string(old))
+        return []byte(strconv.Itoa(n + 1)), nil
+    }
+
+    // Every successful update must be counted, none may be lost
+    var wg sync.WaitGroup
+    var applied atomic.Int64
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 25; j++ {
+                err := store.Update(ctx, "abc", "counter", increment)
+                if err == nil {
+                    applied.Add(1)
+                } else if !errors.Is(err, ErrUpdateConflict) {
+                    t.Errorf("Update() error = %v", err)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+
+    value, err := store.HGet(ctx, "abc", "counter")
+    if err != nil {
+        t.Fatalf("HGet() error = %v", err)
+    }
+    if want := strconv.FormatInt(applied.Load(), 10); value != want {
+        t.Errorf("counter = %s; want %s", value, want)
+    }
+
+    err = store.UpdateSession(ctx, "abc", func(values map[string]string) error {
+        delete(values, "counter")
+        values["a"] = "1"
+        values["b"] = "2"
+        return nil
+    })
+    if err != nil {
+        t.Fatalf("UpdateSession() error = %v", err)
+    }
+    values, _ := store.HGetAll(ctx, "abc")
+    if len(values) != 2 || values["a"] != "1" || values["b"] != "2" {
+        t.Errorf("HGetAll() after UpdateSession() = %v; want map[a:1 b:2]", values)
+    }
+
+    // Returning nil deletes the key, and with it the emptied session
+    for _, key := range []string{"a", "b"} {
+        if err := store.Update(ctx, "abc", key, func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+            t.Fatalf("Update() error = %v", err)
+        }
+    }
+    store.mu.RLock()
+    _, exists := store.sessions["abc"]
+    store.mu.RUnlock()
+    if exists {
+        t.Errorf("emptied session still exists")
+    }
+}
@@ -0,0 +1,59 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+// RedisLogHook is a go-redis hook logging failed and slow commands with the
+// request ID and session ID of the context the command ran with. Add it with
+// client.AddHook(&RedisLogHook{...}).
+type RedisLogHook struct {
+    SlowThreshold time.Duration // commands taking longer are logged, 0 disables it
+}
+
+var _ redis.Hook = (*RedisLogHook)(nil)
+
+func (h *RedisLogHook) DialHook(next redis.DialHook) redis.DialHook {
+    return next
+}
+
+func (h *RedisLogHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+    return func(ctx context.Context, cmd redis.Cmder) error {
+        start := time.Now()
+        err := next(ctx, cmd)
+        h.log(ctx, cmd.FullName(), time.Since(start), err)
+        return err
+    }
+}
+
+func (h *RedisLogHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+    return func(ctx context.Context, cmds []redis.Cmder) error {
+        start := time.Now()
+        err := next(ctx, cmds)
+        h.log(ctx, "pipeline", time.Since(start), err)
+        return err
+    }
+}
+
+// log logs a command if it failed or was slow. A missing key is not a failure.
+// Only a prefix of the session ID is logged, the ID itself is a credential.
+func (h *RedisLogHook) log(ctx context.Context, name string, elapsed time.Duration, err error) {
+    sessionID := SessionIDFromContext(ctx)
+    if len(sessionID) > 8 {
+        sessionID = sessionID[:8] + "..."
+    }
+
+    if err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, redis.TxFailedErr) {
+        logx.Warn(ctx, "redis %s failed for session %q after %s: %v", name, sessionID, elapsed, err)
+        return
+    }
+    if h.SlowThreshold > 0 && elapsed > h.SlowThreshold {
+        logx.Warn(ctx, "redis %s for session %q took %s", name, sessionID, elapsed)
+    }
+}
@@ -0,0 +1,381 @@
+package sessionutils
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/redis/go-redis/v9"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+// rememberKeyPrefix precedes the selector in the Redis keys of remember-me series
+const rememberKeyPrefix = "remember:"
+
+// rememberHistory is how many old validators a series remembers, to tell a
+// reused token from a made-up one
+const rememberHistory = 5
+
+// ErrRememberTokenStolen is returned by RememberStore.ConsumeSeries when an old
+// validator of a series is presented, which means the token was copied
+var ErrRememberTokenStolen = errors.New("remember-me token reused")
+
+// ErrRememberTokenInvalid is returned by RememberStore.ConsumeSeries when a
+// validator that was never issued for the series is presented. The series is
+// kept, anyone who knows a selector could revoke it otherwise.
+var ErrRememberTokenInvalid = errors.New("remember-me token invalid")
+
+// ErrRememberMeDisabled is returned by Remember and Forget when the session
+// middleware has no RememberMe configured
+var ErrRememberMeDisabled = errors.New("remember-me is not configured")
+
+// RememberStore keeps remember-me series. A series is looked up by its
+// selector and holds the hash of its current validator, which changes on
+// every use. Only hashes are stored, so a leaked store does not leak tokens.
+type RememberStore interface {
+    // CreateSeries stores a new series for a user
+    CreateSeries(ctx context.Context, selector, userID, validatorHash string, ttl time.Duration) error
+
+    // ConsumeSeries checks validatorHash against the series and replaces it
+    // with newValidatorHash, extending the series to ttl. The previous
+    // validator is still accepted for grace after a rotation, without
+    // rotating again, so concurrent requests with the same cookie work; then
+    // rotated is false. Any other of the last rememberHistory validators
+    // deletes the series and returns ErrRememberTokenStolen with the user of
+    // the series. A validator never issued for the series returns
+    // ErrRememberTokenInvalid and an unknown series ErrKeyNotFound.
+    ConsumeSeries(ctx context.Context, selector, validatorHash, newValidatorHash string, ttl, grace time.Duration) (userID string, rotated bool, err error)
+
+    // DeleteSeries deletes a series, unknown series are ignored
+    DeleteSeries(ctx context.Context, selector string) error
+}
+
+// RememberMeConfig defines the config for remember-me tokens
+type RememberMeConfig struct {
+    Store      RememberStore
+    CookieName string        // defaults to "remember"
+    Duration   time.Duration // how long an unused token stays valid, defaults to 30 days
+
+    // GracePeriod is how long the previous validator of a series is still
+    // accepted, for concurrent requests carrying the same cookie. Defaults to
+    // 30 seconds, a negative value disables it so any reuse counts as theft.
+    GracePeriod time.Duration
+
+    // OnTheft is called when a stolen token was detected and its series was
+    // revoked, e.g. to revoke the user's sessions and notify the user
+    OnTheft func(ctx context.Context, userID string)
+}
+
+// RememberMe keeps users logged in across sessions with selector/validator
+// tokens: the cookie holds a selector, which identifies the series, and a
+// validator, which is only stored hashed and replaced on every use. With
+// RememberMe set in SessionMiddlewareConfig, a request that starts a new
+// session but carries a valid token gets a session bound to the token's user.
+type RememberMe struct {
+    config RememberMeConfig
+}
+
+// NewRememberMe creates the remember-me subsystem for SessionMiddlewareConfig
+func NewRememberMe(config RememberMeConfig) *RememberMe {
+    if config.CookieName == "" {
+        config.CookieName = "remember"
+    }
+    if config.Duration <= 0 {
+        config.Duration = 30 * 24 * time.Hour
+    }
+    if config.GracePeriod == 0 {
+        config.GracePeriod = 30 * time.Second
+    }
+    if config.GracePeriod < 0 {
+        config.GracePeriod = 0
+    }
+
+    return &RememberMe{config: config}
+}
+
+// newRememberSecret returns n random bytes, base64url encoded
+func newRememberSecret(n int) (string, error) {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashValidator returns the form of a validator that is stored
+func hashValidator(validator string) string {
+    sum := sha256.Sum256([]byte(validator))
+    return hex.EncodeToString(sum[:])
+}
+
+// setCookie sets the remember-me cookie with the attributes of the session cookie
+func (rm *RememberMe) setCookie(c *fiber.Ctx, config SessionMiddlewareConfig, selector, validator string) {
+    config.CookieName = rm.config.CookieName
+    cookie := config.newCookie(selector + "." + validator)
+    cookie.Expires = time.Now().Add(rm.config.Duration)
+
+    writeCookie(c, cookie, config.CookiePartitioned)
+}
+
+// expireCookie tells the client to drop the remember-me cookie
+func (rm *RememberMe) expireCookie(c *fiber.Ctx, config SessionMiddlewareConfig) {
+    config.CookieName = rm.config.CookieName
+    expireSessionCookie(c, config)
+}
+
+// token returns the selector and validator of the remember-me cookie
+func (rm *RememberMe) token(c *fiber.Ctx) (selector, validator string, ok bool) {
+    value := c.Cookies(rm.config.CookieName)
+    if value == "" {
+        return "", "", false
+    }
+
+    selector, validator, ok = strings.Cut(value, ".")
+    if !ok || selector == "" || validator == "" {
+        return "", "", false
+    }
+
+    // Values taken from the request are only valid until the handler returns
+    return strings.Clone(selector), strings.Clone(validator), true
+}
+
+// recall consumes the remember-me cookie of the request and returns the user
+// it belongs to, or "" if there is no valid token
+func (rm *RememberMe) recall(ctx context.Context, c *fiber.Ctx, config SessionMiddlewareConfig) (string, error) {
+    if c.Cookies(rm.config.CookieName) == "" {
+        return "", nil
+    }
+
+    selector, validator, ok := rm.token(c)
+    if !ok {
+        rm.expireCookie(c, config)
+        return "", nil
+    }
+
+    newValidator, err := newRememberSecret(32)
+    if err != nil {
+        return "", err
+    }
+
+    userID, rotated, err := rm.config.Store.ConsumeSeries(ctx, selector, hashValidator(validator), hashValidator(newValidator), rm.config.Duration, rm.config.GracePeriod)
+    switch {
+    case errors.Is(err, ErrKeyNotFound):
+        rm.expireCookie(c, config)
+        return "", nil
+
+    case errors.Is(err, ErrRememberTokenInvalid):
+        rm.expireCookie(c, config)
+        logx.Warn(ctx, "invalid remember-me token presented for user %q", userID)
+        return "", nil
+
+    case errors.Is(err, ErrRememberTokenStolen):
+        rm.expireCookie(c, config)
+        logx.Warn(ctx, "remember-me token of user %q was reused, series revoked", userID)
+        if rm.config.OnTheft != nil {
+            rm.config.OnTheft(ctx, userID)
+        }
+        return "", nil
+
+    case err != nil:
+        return "", err
+    }
+
+    if rotated {
+        rm.setCookie(c, config, selector, newValidator)
+    }
+
+    return userID, nil
+}
+
+// recallLogin starts the new session of the request for the user of its
+// remember-me cookie. It reports whether it did, so the caller leaves the
+// session alone.
+func (config SessionMiddlewareConfig) recallLogin(ctx context.Context, c *fiber.Ctx, sessionID string) (bool, error) {
+    userID, err := config.RememberMe.recall(ctx, c, config)
+    if err != nil || userID == "" {
+        return false, err
+    }
+
+    if err := initSession(ctx, config, sessionID); err != nil {
+        return false, err
+    }
+
+    if index, ok := config.Store.(UserIndex); ok {
+        err = index.BindUser(ctx, sessionID, userID)
+    } else {
+        err = config.Store.HSet(ctx, sessionID, map[string]string{userIDField: userID})
+    }
+    if err != nil {
+        return false, err
+    }
+
+    writeSessionID(c, config, sessionID)
+
+    return true, nil
+}
+
+// Remember issues a remember-me token for the user, e.g. at a login with
+// "keep me logged in" checked. A token the request already carries is revoked.
+// It requires NewSessionMiddleware with RememberMe to run before the handler.
+func Remember(c *fiber.Ctx, userID string) error {
+    config, err := getSessionConfig(c)
+    if err != nil {
+        return err
+    }
+    rm := config.RememberMe
+    if rm == nil {
+        return ErrRememberMeDisabled
+    }
+
+    ctx := requestContext(c)
+
+    if selector, _, ok := rm.token(c); ok {
+        if err := rm.config.Store.DeleteSeries(ctx, selector); err != nil {
+            return err
+        }
+    }
+
+    selector, err := newRememberSecret(12)
+    if err != nil {
+        return err
+    }
+    validator, err := newRememberSecret(32)
+    if err != nil {
+        return err
+    }
+
+    if err := rm.config.Store.CreateSeries(ctx, selector, userID, hashValidator(validator), rm.config.Duration); err != nil {
+        return err
+    }
+
+    rm.setCookie(c, *config, selector, validator)
+
+    return nil
+}
+
+// Forget revokes the remember-me token of the request and expires its
+// cookie, e.g. at logout. It requires NewSessionMiddleware with RememberMe
+// to run before the handler.
+func Forget(c *fiber.Ctx) error {
+    config, err := getSessionConfig(c)
+    if err != nil {
+        return err
+    }
+    rm := config.RememberMe
+    if rm == nil {
+        return ErrRememberMeDisabled
+    }
+
+    if selector, _, ok := rm.token(c); ok {
+        if err := rm.config.Store.DeleteSeries(requestContext(c), selector); err != nil {
+            return err
+        }
+    }
+
+    rm.expireCookie(c, *config)
+
+    return nil
+}
+
+// consumeScript checks and rotates the validator of a remember-me series. The
+// old validators are kept newest first in "history", separated by commas.
+// KEYS[1] series key
+// ARGV[1] validator hash, ARGV[2] new validator hash, ARGV[3] now (ms),
+// ARGV[4] grace (ms), ARGV[5] TTL (ms), ARGV[6] history length
+var consumeScript = redis.NewScript(`
+local series = redis.call("HMGET", KEYS[1], "user_id", "validator", "history", "rotated_at")
+if not series[1] then
+    return false
+end
+local history = {}
+if series[3] then
+    for hash in string.gmatch(series[3], "[^,]+") do
+        history[#history + 1] = hash
+    end
+end
+if series[2] == ARGV[1] then
+    table.insert(history, 1, ARGV[1])
+    while #history > tonumber(ARGV[6]) do
+        table.remove(history)
+    end
+    redis.call("HSET", KEYS[1], "validator", ARGV[2], "history", table.concat(history, ","), "rotated_at", ARGV[3])
+    redis.call("PEXPIRE", KEYS[1], ARGV[5])
+    return {series[1], 1}
+end
+if history[1] == ARGV[1] and tonumber(ARGV[3]) - tonumber(series[4]) < tonumber(ARGV[4]) then
+    return {series[1], 0}
+end
+for _, hash in ipairs(history) do
+    if hash == ARGV[1] then
+        redis.call("DEL", KEYS[1])
+        return {series[1], -1}
+    end
+end
+return {series[1], -2}
+`)
+
+// rememberKey returns the Redis key of a remember-me series
+func (sm *SessionManager) rememberKey(ctx context.Context, selector string) string {
+    return sm.namespace(ctx) + rememberKeyPrefix + selector
+}
+
+// CreateSeries stores a new remember-me series
+func (sm *SessionManager) CreateSeries(ctx context.Context, selector, userID, validatorHash string, ttl time.Duration) error {
+    key := sm.rememberKey(ctx, selector)
+
+    _, err := sm.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+        pipe.HSet(ctx, key, userIDField, userID, "validator", validatorHash)
+        pipe.PExpire(ctx, key, ttl)
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to create remember-me series: %w", unavailable(err))
+    }
+
+    return nil
+}
+
+// ConsumeSeries checks and rotates the validator of a remember-me series using a Lua script
+func (sm *SessionManager) ConsumeSeries(ctx context.Context, selector, validatorHash, newValidatorHash string, ttl, grace time.Duration) (string, bool, error) {
+    key := sm.rememberKey(ctx, selector)
+
+    reply, err := consumeScript.Run(ctx, sm.RedisClient, []string{key},
+        validatorHash, newValidatorHash, time.Now().UnixMilli(), grace.Milliseconds(), ttl.Milliseconds(), rememberHistory).Slice()
+    if err == redis.Nil {
+        return "", false, &notFoundError{key: rememberKeyPrefix + selector}
+    }
+    if err != nil {
+        return "", false, fmt.Errorf("failed to consume remember-me token: %w", unavailable(err))
+    }
+    if len(reply) != 2 {
+        return "", false, fmt.Errorf("unexpected consume reply %v", reply)
+    }
+
+    userID, _ := reply[0].(string)
+    switch reply[1] {
+    case int64(1):
+        return userID, true, nil
+    case int64(0):
+        return userID, false, nil
+    case int64(-2):
+        return userID, false, ErrRememberTokenInvalid
+    }
+    return userID, false, ErrRememberTokenStolen
+}
+
+// DeleteSeries deletes a remember-me series
+func (sm *SessionManager) DeleteSeries(ctx context.Context, selector string) error {
+    if err := sm.RedisClient.Del(ctx, sm.rememberKey(ctx, selector)).Err(); err != nil {
+        return fmt.Errorf("failed to delete remember-me series: %w", unavailable(err))
+    }
+
+    return nil
+}
@@ -0,0 +1,139 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestRememberMe(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    var stolen string
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        RememberMe: NewRememberMe(RememberMeConfig{
+            Store:       store,
+            GracePeriod: -1, // any reuse counts as theft
+            OnTheft: func(ctx context.Context, userID string) {
+                stolen = userID
+            },
+        }),
+    }))
+    app.Get("/login", func(c *fiber.Ctx) error {
+        return Remember(c, "bob")
+    })
+    app.Get("/", func(c *fiber.Ctx) error {
+        userID, _ := store.HGet(context.Background(), MustGetSessionID(c), userIDField)
+        return c.SendString(userID)
+    })
+
+    resp, _ := doRequest(t, app, "GET", "/login", nil)
+    first := sessionCookie(resp, "remember")
+    if first == nil || first.Value == "" {
+        t.Fatalf("login did not set a remember-me cookie")
+    }
+
+    // Without a session cookie, the token restores the login and rotates
+    resp, body := doRequest(t, app, "GET", "/", []*http.Cookie{first})
+    if body != "bob" {
+        t.Errorf("user = %q; want %q", body, "bob")
+    }
+    if sessionCookie(resp, "sid") == nil {
+        t.Errorf("restored login did not set a session cookie")
+    }
+    second := sessionCookie(resp, "remember")
+    if second == nil || second.Value == first.Value {
+        t.Fatalf("remember-me token was not rotated")
+    }
+
+    // A made-up validator is rejected, but does not revoke the series
+    forged := &http.Cookie{Name: "remember", Value: strings.Split(first.Value, ".")[0] + ".forged"}
+    resp, body = doRequest(t, app, "GET", "/", []*http.Cookie{forged})
+    if body != "" || stolen != "" {
+        t.Errorf("forged token got user %q, theft reported for %q; want none", body, stolen)
+    }
+    if cookie := sessionCookie(resp, "remember"); cookie == nil || cookie.Value != "" {
+        t.Errorf("forged token cookie was not expired")
+    }
+
+    // The old token is reused: the series is revoked
+    resp, body = doRequest(t, app, "GET", "/", []*http.Cookie{first})
+    if body != "" || stolen != "bob" {
+        t.Errorf("reused token got user %q, theft reported for %q; want none and %q", body, stolen, "bob")
+    }
+    if cookie := sessionCookie(resp, "remember"); cookie == nil || cookie.Value != "" {
+        t.Errorf("reused token cookie was not expired")
+    }
+
+    if _, body := doRequest(t, app, "GET", "/", []*http.Cookie{second}); body != "" {
+        t.Errorf("token of a revoked series got user %q", body)
+    }
+}
+
+func TestRememberMeGracePeriod(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    ctx := context.Background()
+    if err := store.CreateSeries(ctx, "sel", "bob", "v1", time.Hour); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+
+    if userID, rotated, err := store.ConsumeSeries(ctx, "sel", "v1", "v2", time.Hour, time.Minute); err != nil || !rotated || userID != "bob" {
+        t.Fatalf("ConsumeSeries() = %q, %v, %v; want %q, true, nil", userID, rotated, err, "bob")
+    }
+
+    // A concurrent request with the previous validator is let through
+    if userID, rotated, err := store.ConsumeSeries(ctx, "sel", "v1", "v3", time.Hour, time.Minute); err != nil || rotated || userID != "bob" {
+        t.Errorf("ConsumeSeries() in grace = %q, %v, %v; want %q, false, nil", userID, rotated, err, "bob")
+    }
+
+    if _, _, err := store.ConsumeSeries(ctx, "sel", "v1", "v3", time.Hour, 0); !errors.Is(err, ErrRememberTokenStolen) {
+        t.Errorf("ConsumeSeries() after grace error = %v; want ErrRememberTokenStolen", err)
+    }
+
+    if rm := NewRememberMe(RememberMeConfig{Store: store}); rm.config.GracePeriod != 30*time.Second {
+        t.Errorf("default GracePeriod = %s; want 30s", rm.config.GracePeriod)
+    }
+}
+
+func TestRememberMeHistory(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    ctx := context.Background()
+    if err := store.CreateSeries(ctx, "sel", "bob", "v0", time.Hour); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+    for i := 0; i <= rememberHistory; i++ {
+        if _, _, err := store.ConsumeSeries(ctx, "sel", "v"+strconv.Itoa(i), "v"+strconv.Itoa(i+1), time.Hour, 0); err != nil {
+            t.Fatalf("ConsumeSeries() error = %v", err)
+        }
+    }
+
+    // Neither a validator that was never issued nor one too old to remember revokes the series
+    for _, validator := range []string{"forged", "v0"} {
+        if _, _, err := store.ConsumeSeries(ctx, "sel", validator, "x", time.Hour, 0); !errors.Is(err, ErrRememberTokenInvalid) {
+            t.Errorf("ConsumeSeries(%q) error = %v; want ErrRememberTokenInvalid", validator, err)
+        }
+    }
+
+    if _, _, err := store.ConsumeSeries(ctx, "sel", "v1", "x", time.Hour, 0); !errors.Is(err, ErrRememberTokenStolen) {
+        t.Errorf("ConsumeSeries() with an old validator error = %v; want ErrRememberTokenStolen", err)
+    }
+    if _, _, err := store.ConsumeSeries(ctx, "sel", "v6", "x", time.Hour, 0); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("ConsumeSeries() after theft error = %v; want ErrKeyNotFound", err)
+    }
+}
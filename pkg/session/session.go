@@ -4,10 +4,14 @@ import (
     "context"
     "crypto/rand"
     "encoding/hex"
+    "errors"
     "strconv"
+    "strings"
     "time"
 
     "github.com/gofiber/fiber/v2"
+
+    "github.com/jsuto/go-kit/pkg/logx"
 )
 
 // SessionMiddlewareConfig defines the config for the session middleware
@@ -17,62 +21,283 @@ type SessionMiddlewareConfig struct {
     Secure               bool
     SessionDuration      time.Duration
     RegenerateAfter      time.Duration
+    RotationGracePeriod  time.Duration // how long a rotated session ID keeps pointing at the new one, defaults to 10s, negative disables it
+    IdleTimeout          time.Duration // ends a session after this long without a request, 0 disables it
+    AbsoluteTimeout      time.Duration // ends a session this long after it was started, 0 disables it
+
+    // Cookie attributes, see cookie.go. A CookieName starting with "__Host-" or
+    // "__Secure-" enforces the attributes the prefix requires.
+    CookieSameSite    string // "Lax" (default), "Strict", "None" (implies Secure) or "disabled"
+    CookieDomain      string
+    CookiePath        string // defaults to "/"
+    CookiePartitioned bool   // CHIPS partitioned cookie, implies Secure
+    CookieSessionOnly bool   // no Expires, the cookie ends with the browser session
+
+    // Signer, if set, signs the session ID in the cookie. Cookies with a missing
+    // or invalid signature are treated as no session and a new one is issued.
+    Signer *Signer
+
+    // Hooks are called on session lifecycle events. Their errors are logged
+    // and ignored, unless HookErrorsFatal is set: then the error aborts the
+    // request and is returned by the middleware or helper that fired the hook.
+    Hooks           SessionHooks
+    HookErrorsFatal bool
+
+    // Transports carry the session ID between client and server, tried in order.
+    // Replies go back over the transport the ID arrived on, a new session is
+    // sent over the first one only. Defaults to the session cookie only, see
+    // CookieTransport and HeaderTransport.
+    Transports []Transport
+
+    // RefreshThreshold and RefreshInterval throttle the sliding expiration,
+    // which by default sets the TTL of the session on every request. With a
+    // threshold, e.g. 0.5, the TTL is only set once less than that fraction of
+    // SessionDuration remains. With an interval, it is set when this process
+    // did not set it for that long. If both are set, either one triggers it.
+    // The interval must be shorter than SessionDuration and IdleTimeout.
+    RefreshThreshold float64
+    RefreshInterval  time.Duration
+
+    // TenantResolver, if set, resolves the tenant of every request. Sessions
+    // are bound to their tenant: the store namespaces their keys (see
+    // SessionManager), the signature of the session ID only verifies for the
+    // same tenant, and a session of another tenant is treated as unknown.
+    TenantResolver TenantResolver
+
+    // Lazy defers storing a new session and setting its cookie until a handler
+    // writes session data through StoreFrom, the typed accessors or BindUser.
+    // Requests that never write, like bots and health checks, create nothing.
+    // The session is stored with its TTL before the first write, the cookie is
+    // set once the handler returned. Writes to the Store itself go unnoticed,
+    // they leave data without a TTL under an ID the client never receives.
+    Lazy bool
+
+    // ExpiredHandler is called when a session reached IdleTimeout or AbsoluteTimeout,
+    // after the session was cleared and its cookie expired. Its return value is
+    // returned by the middleware, e.g. a redirect to the login page.
+    // If nil, a new session is started and the request continues.
+    ExpiredHandler fiber.Handler
+
+    // ErrorHandler is called when the session cannot be loaded or stored and
+    // the failure policy is FailClosed. Store errors wrap ErrStoreUnavailable
+    // or ErrSessionInvalid. Defaults to fiber.ErrServiceUnavailable when the
+    // store is unavailable and fiber.ErrInternalServerError otherwise.
+    // Errors of fatal hooks are returned as they are.
+    ErrorHandler fiber.ErrorHandler
+
+    // RememberMe, if set, restores the login of users with a remember-me
+    // token when their session is gone, see NewRememberMe and Remember
+    RememberMe *RememberMe
+
+    // OperationTimeout, if set, bounds the store calls the middleware makes to
+    // load, refresh, rotate or create the session before the handler runs, and
+    // to store a lazy session after it, on top of the deadline of the request
+    // context. The calls before the handler share one deadline, including
+    // retries of the Redis client. Store calls of handlers and of helpers like
+    // Regenerate run on the user context of the request and are not bounded.
+    OperationTimeout time.Duration
+
+    // FailurePolicy decides how requests continue when the session fails,
+    // FailurePolicyFor, if set, decides it per request, e.g. to fail open on
+    // public pages only. Every failure is logged either way.
+    FailurePolicy    FailurePolicy
+    FailurePolicyFor func(c *fiber.Ctx) FailurePolicy
+
+    touches *touchCache // last TTL refresh per session, for RefreshInterval
 }
 
+// defaultRotationGracePeriod covers requests that were sent with the old
+// session ID while the rotation was in flight
+const defaultRotationGracePeriod = 10 * time.Second
+
+// sessionConfigKey is the Fiber locals key holding the middleware config,
+// used by helpers such as Regenerate and Destroy
+const sessionConfigKey = "session_config"
+
 // NewSessionMiddleware returns a Fiber middleware that handles
-// session ID creation, TTL refreshing, and optional session ID rotation
+// session ID creation, TTL refreshing, lifetime limits and optional session ID rotation
 func NewSessionMiddleware(config SessionMiddlewareConfig) fiber.Handler {
-    return func(c *fiber.Ctx) error {
-        ctx := context.Background()
+    if err := config.validateCookie(); err != nil {
+        panic("sessionutils: " + err.Error())
+    }
+    if err := config.validateTenants(); err != nil {
+        panic("sessionutils: " + err.Error())
+    }
+    if err := config.validateRefresh(); err != nil {
+        panic("sessionutils: " + err.Error())
+    }
+    if config.RefreshInterval > 0 {
+        config.touches = newTouchCache()
+    }
+    switch {
+    case config.RotationGracePeriod == 0:
+        config.RotationGracePeriod = defaultRotationGracePeriod
+    case config.RotationGracePeriod < 0:
+        config.RotationGracePeriod = 0
+    }
 
-        sessionID, isNew, err := GetOrCreateSessionID(c, config.CookieName, config.Secure, config.SessionDuration)
-        if err != nil {
-            return fiber.ErrInternalServerError
+    if config.ErrorHandler == nil {
+        config.ErrorHandler = defaultErrorHandler
+    }
+
+    return func(c *fiber.Ctx) error {
+        if err := resolveTenant(c, config); err != nil {
+            return err
         }
 
-        if isNew {
-            // New session, set created_at
-            err := config.Store.HSet(ctx, sessionID, map[string]string{
-                "created_at": strconv.FormatInt(time.Now().Unix(), 10),
-            })
-            if err != nil {
-                return fiber.ErrInternalServerError
-            }
-        } else {
-            // Existing session, refresh TTL
-            if err := config.Store.Expire(ctx, sessionID, config.SessionDuration); err != nil {
-                return fiber.ErrInternalServerError
-            }
+        c.Locals(sessionConfigKey, &config)
 
-            // Optionally rotate session ID
-            createdAtStr, err := config.Store.HGet(ctx, sessionID, "created_at")
-            if err == nil {
-                createdAtUnix, err := strconv.ParseInt(createdAtStr, 10, 64)
-                if err == nil {
-                    createdAt := time.Unix(createdAtUnix, 0)
-                    if time.Since(createdAt) > config.RegenerateAfter {
-                        newSessionID, err := rotateSessionID(ctx, c, config, sessionID)
-                        if err != nil {
-                            return fiber.ErrInternalServerError
-                        }
-                        sessionID = newSessionID
-                    }
-                }
+        // Store calls run on the request context, so they end with the
+        // request and logs and Redis hooks see the request ID
+        c.SetUserContext(userContext(c))
+        ctx := requestContext(c)
+
+        opCtx, cancel := config.operationContext(ctx)
+        sessionID, isNew, err := config.openSession(opCtx, c)
+        if sessionID != "" {
+            ctx = WithSessionID(ctx, sessionID)
+            opCtx = WithSessionID(opCtx, sessionID)
+        }
+        if errors.Is(err, errSessionExpired) {
+            cancel()
+            clearSessionID(c, config)
+            return config.ExpiredHandler(c)
+        }
+        // A new session of a user with a remember-me token starts logged in
+        remembered := false
+        if err == nil && isNew && config.RememberMe != nil {
+            remembered, err = config.recallLogin(opCtx, c, sessionID)
+        }
+        if err == nil && isNew && !remembered && !config.Lazy {
+            // The ID is only sent once the session is stored, so a failure
+            // does not replace the client's ID with one that does not exist
+            if err = initSession(opCtx, config, sessionID); err == nil {
+                writeSessionID(c, config, sessionID)
             }
         }
+        cancel()
+        if err != nil {
+            return config.handleError(c, err)
+        }
 
         // Store session ID in Fiber locals
         c.Locals("session_id", sessionID)
+        c.SetUserContext(WithSessionID(c.UserContext(), sessionID))
+
+        if isNew && !remembered && config.Lazy {
+            // Keep the new session in request state until a handler writes to it
+            c.Locals(pendingSessionKey, &pendingSession{})
+
+            err := c.Next()
+
+            opCtx, cancel := config.operationContext(ctx)
+            defer cancel()
+            if commitErr := commitPendingSession(opCtx, c, config); commitErr != nil && err == nil {
+                return config.handleCommitError(c, commitErr)
+            }
+            return err
+        }
 
         return c.Next()
     }
 }
 
+// errSessionExpired tells the middleware to hand an expired session to the ExpiredHandler
+var errSessionExpired = errors.New("session expired")
+
+// openSession resolves the session of the request: it refreshes an existing
+// session, rotates its ID when due, and replaces unknown, expired and foreign
+// sessions with a new one. Whether the session is new is reported, so the
+// caller can store it.
+func (config SessionMiddlewareConfig) openSession(ctx context.Context, c *fiber.Ctx) (string, bool, error) {
+    sessionID, ok := readSessionID(c, config)
+    if !ok {
+        sessionID, err := generateSessionID()
+        return sessionID, true, err
+    }
+
+    ctx = WithSessionID(ctx, sessionID)
+    now := time.Now()
+
+    state, err := config.touchSession(ctx, sessionID, now)
+    if errors.Is(err, ErrKeyNotFound) {
+        // The session may have been rotated by a concurrent request
+        // carrying the same cookie, follow it to the new ID
+        if newSessionID, ok := resolveRotatedSession(ctx, config.Store, sessionID); ok {
+            sessionID = newSessionID
+            ctx = WithSessionID(ctx, sessionID)
+            writeSessionID(c, config, sessionID)
+            state, err = config.touchSession(ctx, sessionID, now)
+        }
+    }
+
+    switch {
+    case errors.Is(err, ErrKeyNotFound):
+        // Never adopt an ID the store does not know, it may be fixated
+        sessionID, err = restartSession(c, config)
+        return sessionID, true, err
+
+    case err != nil:
+        return "", false, err
+
+    case state.foreign:
+        // A session of another tenant is left alone, start a new one
+        sessionID, err = restartSession(c, config)
+        return sessionID, true, err
+
+    case state.times.expired(config, now):
+        _ = config.Store.Clear(ctx, sessionID)
+
+        if err := config.fireExpire(ctx, sessionID); err != nil {
+            return "", false, err
+        }
+        if config.ExpiredHandler != nil {
+            return "", false, errSessionExpired
+        }
+
+        // Start over with a fresh session
+        sessionID, err = restartSession(c, config)
+        return sessionID, true, err
+    }
+
+    if state.refreshed {
+        // The TTL must not outlast the absolute lifetime
+        if ttl := config.sessionTTL(state.times, now); ttl < config.SessionDuration {
+            if err := config.Store.Expire(ctx, sessionID, ttl); err != nil {
+                return "", false, err
+            }
+        }
+
+        if err := config.fireRefresh(ctx, sessionID); err != nil {
+            return "", false, err
+        }
+    }
+
+    // Optionally rotate session ID
+    if now.Sub(state.times.createdAt) > config.RegenerateAfter {
+        sessionID, err = rotateSessionID(ctx, c, config, sessionID, true, config.RotationGracePeriod)
+        if err != nil {
+            return "", false, err
+        }
+    }
+
+    return sessionID, false, nil
+}
+
 // GetOrCreateSessionID checks if a session ID cookie exists, otherwise creates one
 func GetOrCreateSessionID(c *fiber.Ctx, cookieName string, secure bool, sessionDuration time.Duration) (sessionID string, isNew bool, err error) {
-    cookie := c.Cookies(cookieName)
-    if cookie != "" {
-        return cookie, false, nil
+    return getOrCreateSessionID(c, SessionMiddlewareConfig{
+        CookieName:      cookieName,
+        Secure:          secure,
+        SessionDuration: sessionDuration,
+    })
+}
+
+// getOrCreateSessionID returns the session ID sent over one of the transports, or generates
+// a new one. A new ID is sent to the client right away unless the session is lazy.
+func getOrCreateSessionID(c *fiber.Ctx, config SessionMiddlewareConfig) (sessionID string, isNew bool, err error) {
+    if sessionID, ok := readSessionID(c, config); ok {
+        return sessionID, false, nil
     }
 
     // Generate new session ID
@@ -81,20 +306,30 @@ func GetOrCreateSessionID(c *fiber.Ctx, cookieName string, secure bool, sessionD
         return "", false, err
     }
 
-    // Set cookie
-    c.Cookie(&fiber.Cookie{
-        Name:     cookieName,
-        Value:    sessionID,
-        HTTPOnly: true,
-        Secure:   secure,
-        SameSite: "Lax",
-        Path:     "/",
-        Expires:  time.Now().Add(sessionDuration),
-    })
+    // Send it to the client
+    if !config.Lazy {
+        writeSessionID(c, config, sessionID)
+    }
 
     return sessionID, true, nil
 }
 
+// restartSession replaces the session ID of the request with a new one. The
+// new ID is sent once the session is stored. A lazy session may never be
+// stored, so the old ID is dropped right away.
+func restartSession(c *fiber.Ctx, config SessionMiddlewareConfig) (string, error) {
+    sessionID, err := generateSessionID()
+    if err != nil {
+        return "", err
+    }
+
+    if config.Lazy {
+        clearSessionID(c, config)
+    }
+
+    return sessionID, nil
+}
+
 // generateSessionID creates a new random session ID
 func generateSessionID() (string, error) {
     bytes := make([]byte, 32)
@@ -105,48 +340,262 @@ func generateSessionID() (string, error) {
     return hex.EncodeToString(bytes), nil
 }
 
-// rotateSessionID generates a new session ID, copies data from old session, and deletes old session
-func rotateSessionID(ctx context.Context, c *fiber.Ctx, config SessionMiddlewareConfig, oldSessionID string) (string, error) {
-    // Dump old session data
-    oldData, err := config.Store.HGetAll(ctx, oldSessionID)
+// requestContext returns the context used for store calls made on behalf of
+// a request: the user context with the Fiber context, which stores such as
+// CookieStore need. It must not be used after the handler returned.
+func requestContext(c *fiber.Ctx) context.Context {
+    ctx := userContext(c)
+    if fc, ok := FiberCtxFrom(ctx); !ok || fc != c {
+        ctx = WithFiberCtx(ctx, c)
+    }
+    return ctx
+}
+
+// userContext returns the user context of the request with the tenant, the
+// session ID and the request ID. It leaves out the Fiber context, which is
+// recycled after the request, as c.UserContext() may be kept by goroutines
+// that outlive it.
+func userContext(c *fiber.Ctx) context.Context {
+    ctx := c.UserContext()
+
+    if tenant := GetTenant(c); tenant != "" && TenantFromContext(ctx) != tenant {
+        ctx = WithTenant(ctx, tenant)
+    }
+    if sessionID, ok := c.Locals("session_id").(string); ok && SessionIDFromContext(ctx) != sessionID {
+        ctx = WithSessionID(ctx, sessionID)
+    }
+    if logx.GetRequestID(ctx) == "" {
+        if requestID := requestIDOf(c); requestID != "" {
+            ctx = logx.WithRequestID(ctx, requestID)
+        }
+    }
+
+    return ctx
+}
+
+// operationContext bounds the store calls the middleware makes in one go,
+// e.g. before the handler runs, to OperationTimeout
+func (config SessionMiddlewareConfig) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    if config.OperationTimeout > 0 {
+        return context.WithTimeout(ctx, config.OperationTimeout)
+    }
+    return ctx, func() {}
+}
+
+// requestIDOf returns the ID set by the requestid middleware of Fiber, if any
+func requestIDOf(c *fiber.Ctx) string {
+    if requestID, ok := c.Locals("requestid").(string); ok && requestID != "" {
+        return requestID
+    }
+    // Header values are only valid until the handler returns
+    return strings.Clone(c.GetRespHeader(fiber.HeaderXRequestID))
+}
+
+// rotateSessionID generates a new session ID, copies data from old session if keepData is set,
+// and deletes old session. For the grace period the old ID is kept as an alias of the new one,
+// so concurrent requests still carrying the old cookie end up in the same session.
+func rotateSessionID(ctx context.Context, c *fiber.Ctx, config SessionMiddlewareConfig, oldSessionID string, keepData bool, grace time.Duration) (string, error) {
+    // Generate new session ID
+    generatedID, err := generateSessionID()
     if err != nil {
         return "", err
     }
+    newSessionID := generatedID
 
-    // Generate new session ID
-    newSessionID, err := generateSessionID()
+    opts := RotateOptions{
+        KeepData: keepData,
+        Fields: map[string]string{
+            createdAtField: strconv.FormatInt(time.Now().Unix(), 10),
+        },
+        TTL:   config.SessionDuration,
+        Grace: grace,
+    }
+    if tenant := TenantFromContext(ctx); tenant != "" {
+        opts.Fields[tenantField] = tenant
+    }
+
+    // Prefer an atomic rotation when the store supports it
+    if rotator, ok := config.Store.(Rotator); ok {
+        newSessionID, err = rotator.RotateSession(ctx, oldSessionID, newSessionID, opts)
+    } else {
+        newSessionID, err = copySession(ctx, config.Store, oldSessionID, newSessionID, opts)
+    }
     if err != nil {
         return "", err
     }
 
+    // Send the new ID back the way the old one came in
+    writeSessionID(c, config, newSessionID)
+
+    if newSessionID != generatedID {
+        // A concurrent request already rotated the session, which issued
+        // the CSRF token and fired the hook for it
+        return newSessionID, nil
+    }
+
+    // The CSRF token rotates with the session ID. This is best effort,
+    // the old token stays valid if it fails.
+    _ = rotateCSRFToken(ctx, c, config.Store, newSessionID, grace)
+
+    if err := config.fireRotate(ctx, oldSessionID, newSessionID); err != nil {
+        return "", err
+    }
+
+    return newSessionID, nil
+}
+
+// copySession is the non-atomic rotation used for stores that do not implement Rotator
+func copySession(ctx context.Context, store Store, oldSessionID, newSessionID string, opts RotateOptions) (string, error) {
+    // Dump old session data
+    data := map[string]string{}
+    if opts.KeepData {
+        oldData, err := store.HGetAll(ctx, oldSessionID)
+        if err != nil {
+            return "", err
+        }
+        if target, ok := oldData[rotatedToField]; ok {
+            // Already rotated by a concurrent request
+            return target, nil
+        }
+        data = oldData
+    }
+
     // Copy old data to new session
-    oldData["created_at"] = strconv.FormatInt(time.Now().Unix(), 10)
-    if err := config.Store.HSet(ctx, newSessionID, oldData); err != nil {
+    for k, v := range opts.Fields {
+        data[k] = v
+    }
+    if err := store.HSet(ctx, newSessionID, data); err != nil {
         return "", err
     }
 
+    if index, ok := store.(UserIndex); ok && data[userIDField] != "" {
+        if err := index.BindUser(ctx, newSessionID, data[userIDField]); err != nil {
+            return "", err
+        }
+    }
+
     // Set TTL for new session
-    if err := config.Store.Expire(ctx, newSessionID, config.SessionDuration); err != nil {
+    if opts.TTL > 0 {
+        if err := store.Expire(ctx, newSessionID, opts.TTL); err != nil {
+            return "", err
+        }
+    }
+
+    // Delete old session, optionally leaving an alias behind
+    _ = store.Clear(ctx, oldSessionID)
+
+    if opts.Grace > 0 {
+        if err := store.HSet(ctx, oldSessionID, map[string]string{rotatedToField: newSessionID}); err != nil {
+            return "", err
+        }
+        if err := store.Expire(ctx, oldSessionID, opts.Grace); err != nil {
+            return "", err
+        }
+    }
+
+    return newSessionID, nil
+}
+
+// resolveRotatedSession follows the alias left behind by a rotation
+func resolveRotatedSession(ctx context.Context, store Store, sessionID string) (string, bool) {
+    resolved := false
+
+    for i := 0; i < maxRotationHops; i++ {
+        target, err := store.HGet(ctx, sessionID, rotatedToField)
+        if err != nil || target == "" {
+            break
+        }
+        sessionID = target
+        resolved = true
+    }
+
+    return sessionID, resolved
+}
+
+// Regenerate rotates the session ID of the current request, e.g. at login, logout
+// or on a privilege change, to prevent session fixation. If keepData is set the
+// session data is copied to the new ID, otherwise a fresh, empty session is started.
+// The old session is deleted, the cookie is reissued and c.Locals("session_id")
+// is updated. It requires NewSessionMiddleware to run before the handler.
+func Regenerate(c *fiber.Ctx, keepData bool) (string, error) {
+    config, err := getSessionConfig(c)
+    if err != nil {
         return "", err
     }
 
-    // Delete old session
-    _ = config.Store.Clear(ctx, oldSessionID)
+    oldSessionID, err := GetSessionID(c)
+    if err != nil {
+        return "", err
+    }
 
-    // Set new cookie
-    c.Cookie(&fiber.Cookie{
-        Name:     config.CookieName,
-        Value:    newSessionID,
-        HTTPOnly: true,
-        Secure:   config.Secure,
-        SameSite: "Lax",
-        Path:     "/",
-        Expires:  time.Now().Add(config.SessionDuration),
-    })
+    if pending := pendingSessionFrom(c); pending != nil {
+        if !pending.stored {
+            // Nothing was stored yet, a new ID in request state is enough
+            newSessionID, err := generateSessionID()
+            if err != nil {
+                return "", err
+            }
+            c.Locals("session_id", newSessionID)
+            c.SetUserContext(WithSessionID(c.UserContext(), newSessionID))
+            return newSessionID, nil
+        }
+
+        if err := commitPendingSession(requestContext(c), c, *config); err != nil {
+            return "", unwrapHookError(err)
+        }
+    }
+
+    // No grace period here: the old ID must stop working at once, otherwise
+    // a fixated ID would keep pointing at the new session
+    newSessionID, err := rotateSessionID(requestContext(c), c, *config, oldSessionID, keepData, 0)
+    if err != nil {
+        return "", unwrapHookError(err)
+    }
+
+    c.Locals("session_id", newSessionID)
+    c.SetUserContext(WithSessionID(c.UserContext(), newSessionID))
 
     return newSessionID, nil
 }
 
+// Destroy deletes the current session from the store and expires the session cookie.
+// It requires NewSessionMiddleware to run before the handler.
+func Destroy(c *fiber.Ctx) error {
+    config, err := getSessionConfig(c)
+    if err != nil {
+        return err
+    }
+
+    sessionID, err := GetSessionID(c)
+    if err != nil {
+        return err
+    }
+
+    // A lazy session must not be committed after it was destroyed
+    c.Locals(pendingSessionKey, nil)
+
+    ctx := requestContext(c)
+
+    if err := config.Store.Clear(ctx, sessionID); err != nil {
+        return err
+    }
+
+    clearSessionID(c, *config)
+
+    c.Locals("session_id", nil)
+
+    return unwrapHookError(config.fireDestroy(ctx, sessionID))
+}
+
+// getSessionConfig returns the config of the session middleware handling the request
+func getSessionConfig(c *fiber.Ctx) (*SessionMiddlewareConfig, error) {
+    config, ok := c.Locals(sessionConfigKey).(*SessionMiddlewareConfig)
+    if !ok || config == nil {
+        return nil, fiber.NewError(fiber.StatusInternalServerError, "session middleware is not configured")
+    }
+    return config, nil
+}
+
 // GetSessionID safely extracts session ID from Fiber Locals
 func GetSessionID(c *fiber.Ctx) (string, error) {
     val := c.Locals("session_id")
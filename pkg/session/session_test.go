@@ -0,0 +1,614 @@
+package sessionutils
+
+import (
+    "context"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/valyala/fasthttp"
+
+    "github.com/jsuto/go-kit/pkg/logx"
+)
+
+func sessionCookie(resp *http.Response, name string) *http.Cookie {
+    for _, cookie := range resp.Cookies() {
+        if cookie.Name == name {
+            return cookie
+        }
+    }
+    return nil
+}
+
+func TestRegenerateAndDestroy(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Get("/login", func(c *fiber.Ctx) error {
+        if err := store.Save(ctx, MustGetSessionID(c), "user", "alice"); err != nil {
+            return err
+        }
+        keep := c.Query("keep") == "1"
+        newID, err := Regenerate(c, keep)
+        if err != nil {
+            return err
+        }
+        if MustGetSessionID(c) != newID {
+            t.Errorf("session_id local = %q; want %q", MustGetSessionID(c), newID)
+        }
+        return c.SendString(newID)
+    })
+    app.Get("/logout", func(c *fiber.Ctx) error {
+        return Destroy(c)
+    })
+
+    resp, _ := doRequest(t, app, "GET", "/", nil)
+    first := sessionCookie(resp, "sid")
+    if first == nil {
+        t.Fatalf("no session cookie was set")
+    }
+
+    for _, keep := range []bool{true, false} {
+        target := "/login"
+        if keep {
+            target += "?keep=1"
+        }
+        resp, newID := doRequest(t, app, "GET", target, []*http.Cookie{first})
+
+        if cookie := sessionCookie(resp, "sid"); cookie == nil || cookie.Value != newID {
+            t.Fatalf("cookie was not reissued with the new ID %q", newID)
+        }
+        if all, _ := store.HGetAll(ctx, first.Value); len(all) != 0 {
+            t.Errorf("old session still has data: %v", all)
+        }
+
+        _, err := store.HGet(ctx, newID, "user")
+        if keep && err != nil {
+            t.Errorf("Regenerate(keepData=true) lost data: %v", err)
+        }
+        if !keep && err == nil {
+            t.Errorf("Regenerate(keepData=false) kept data")
+        }
+
+        first = &http.Cookie{Name: "sid", Value: newID}
+    }
+
+    resp, _ = doRequest(t, app, "GET", "/logout", []*http.Cookie{first})
+    if cookie := sessionCookie(resp, "sid"); cookie == nil || cookie.Value != "" {
+        t.Errorf("Destroy() did not expire the cookie")
+    }
+    if all, _ := store.HGetAll(ctx, first.Value); len(all) != 0 {
+        t.Errorf("Destroy() left session data: %v", all)
+    }
+}
+
+func TestRotationGracePeriod(t *testing.T) {
+    ctx := context.Background()
+    opts := RotateOptions{
+        KeepData: true,
+        Fields:   map[string]string{"created_at": "1"},
+        TTL:      time.Hour,
+        Grace:    time.Minute,
+    }
+
+    stores := map[string]func(store *MemoryStore, oldID, newID string) (string, error){
+        "atomic": func(store *MemoryStore, oldID, newID string) (string, error) {
+            return store.RotateSession(ctx, oldID, newID, opts)
+        },
+        "fallback": func(store *MemoryStore, oldID, newID string) (string, error) {
+            return copySession(ctx, store, oldID, newID, opts)
+        },
+    }
+
+    for name, rotate := range stores {
+        t.Run(name, func(t *testing.T) {
+            store := NewMemoryStore(0)
+            defer store.Close()
+
+            if err := store.HSet(ctx, "old", map[string]string{"user": "alice"}); err != nil {
+                t.Fatalf("HSet() error = %v", err)
+            }
+
+            target, err := rotate(store, "old", "new")
+            if err != nil || target != "new" {
+                t.Fatalf("rotate() = %q, %v; want %q, nil", target, err, "new")
+            }
+
+            // A concurrent rotation of the same old ID must not fork the session
+            target, err = rotate(store, "old", "other")
+            if err != nil || target != "new" {
+                t.Errorf("second rotate() = %q, %v; want %q, nil", target, err, "new")
+            }
+
+            if resolved, ok := resolveRotatedSession(ctx, store, "old"); !ok || resolved != "new" {
+                t.Errorf("resolveRotatedSession() = %q, %v; want %q, true", resolved, ok, "new")
+            }
+            if user, err := store.HGet(ctx, "new", "user"); err != nil || user != "alice" {
+                t.Errorf("HGet() on new session = %q, %v; want %q, nil", user, err, "alice")
+            }
+            if _, err := store.HGet(ctx, "old", "user"); err == nil {
+                t.Errorf("old session still holds data")
+            }
+        })
+    }
+}
+
+func TestConcurrentRotation(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    if err := store.HSet(ctx, "old", map[string]string{createdAtField: "1", csrfTokenField: "token"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    rotations := 0
+    config := SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        Hooks: SessionHooks{
+            OnRotate: func(ctx context.Context, oldSessionID, newSessionID string) error {
+                rotations++
+                return nil
+            },
+        },
+    }
+
+    app := fiber.New()
+    c := app.AcquireCtx(&fasthttp.RequestCtx{})
+    defer app.ReleaseCtx(c)
+
+    first, err := rotateSessionID(ctx, c, config, "old", true, time.Minute)
+    if err != nil {
+        t.Fatalf("rotateSessionID() error = %v", err)
+    }
+    token, _ := store.HGet(ctx, first, csrfTokenField)
+
+    // A request that raced with the first one joins its session
+    second, err := rotateSessionID(ctx, c, config, "old", true, time.Minute)
+    if err != nil || second != first {
+        t.Fatalf("second rotateSessionID() = %q, %v; want %q, nil", second, err, first)
+    }
+
+    if again, _ := store.HGet(ctx, first, csrfTokenField); again != token {
+        t.Errorf("CSRF token rotated again: %q; want %q", again, token)
+    }
+    if rotations != 1 {
+        t.Errorf("OnRotate fired %d times; want 1", rotations)
+    }
+}
+
+func TestSessionLifetimeLimits(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    newApp := func(expiredHandler fiber.Handler) *fiber.App {
+        app := fiber.New()
+        app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+            Store:           store,
+            CookieName:      "sid",
+            SessionDuration: 24 * time.Hour,
+            RegenerateAfter: 24 * time.Hour,
+            IdleTimeout:     time.Hour,
+            AbsoluteTimeout: 8 * time.Hour,
+            ExpiredHandler:  expiredHandler,
+        }))
+        app.Get("/", func(c *fiber.Ctx) error {
+            return c.SendString(MustGetSessionID(c))
+        })
+        return app
+    }
+
+    longAgo := strconv.FormatInt(time.Now().Add(-9*time.Hour).Unix(), 10)
+
+    tests := []struct {
+        name   string
+        field  string
+        status int
+    }{
+        {"IdleTimeout", lastAccessField, fiber.StatusOK},
+        {"AbsoluteTimeout", startedAtField, fiber.StatusUnauthorized},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var expiredHandler fiber.Handler
+            if tt.status != fiber.StatusOK {
+                expiredHandler = func(c *fiber.Ctx) error {
+                    return c.SendStatus(tt.status)
+                }
+            }
+            app := newApp(expiredHandler)
+
+            resp, _ := doRequest(t, app, "GET", "/", nil)
+            cookie := sessionCookie(resp, "sid")
+
+            // An active session within both limits is kept
+            if _, body := doRequest(t, app, "GET", "/", []*http.Cookie{cookie}); body != cookie.Value {
+                t.Fatalf("session changed within limits: got %q, want %q", body, cookie.Value)
+            }
+
+            if err := store.HSet(ctx, cookie.Value, map[string]string{tt.field: longAgo}); err != nil {
+                t.Fatalf("HSet() error = %v", err)
+            }
+
+            resp, body := doRequest(t, app, "GET", "/", []*http.Cookie{cookie})
+            if resp.StatusCode != tt.status {
+                t.Errorf("status = %d; want %d", resp.StatusCode, tt.status)
+            }
+            if body == cookie.Value {
+                t.Errorf("expired session was reused")
+            }
+            if all, _ := store.HGetAll(ctx, cookie.Value); len(all) != 0 {
+                t.Errorf("expired session was not cleared: %v", all)
+            }
+        })
+    }
+}
+
+func TestLazySession(t *testing.T) {
+    ctx := context.Background()
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        Lazy:            true,
+    }))
+    app.Get("/health", func(c *fiber.Ctx) error {
+        return c.SendString(MustGetSessionID(c))
+    })
+    app.Post("/cart", func(c *fiber.Ctx) error {
+        if err := Set(c, "cart", []string{"apple"}); err != nil {
+            return err
+        }
+        return c.SendString(MustGetSessionID(c))
+    })
+    var failedID string
+    app.Post("/fail", func(c *fiber.Ctx) error {
+        failedID = MustGetSessionID(c)
+        if err := Set(c, "cart", []string{"apple"}); err != nil {
+            return err
+        }
+        return fiber.ErrInternalServerError
+    })
+
+    resp, sessionID := doRequest(t, app, "GET", "/health", nil)
+    if sessionID == "" {
+        t.Errorf("lazy session has no ID in request state")
+    }
+    if cookie := sessionCookie(resp, "sid"); cookie != nil {
+        t.Errorf("read-only request set a session cookie")
+    }
+    if all, _ := store.HGetAll(ctx, sessionID); len(all) != 0 {
+        t.Errorf("read-only request stored a session: %v", all)
+    }
+
+    resp, sessionID = doRequest(t, app, "POST", "/cart", nil)
+    cookie := sessionCookie(resp, "sid")
+    if cookie == nil || cookie.Value != sessionID {
+        t.Fatalf("writing request did not set the session cookie")
+    }
+    if _, err := store.HGet(ctx, sessionID, createdAtField); err != nil {
+        t.Errorf("committed session has no created_at: %v", err)
+    }
+    if _, err := store.HGet(ctx, sessionID, "cart"); err != nil {
+        t.Errorf("committed session lost its data: %v", err)
+    }
+
+    // Data is never stored without the session's lifetime fields and TTL
+    doRequest(t, app, "POST", "/fail", nil)
+    store.mu.RLock()
+    entry := store.sessions[failedID]
+    store.mu.RUnlock()
+    if entry == nil || entry.expiresAt.IsZero() || entry.values[createdAtField] == "" {
+        t.Errorf("session written by a failed request has no TTL or created_at: %+v", entry)
+    }
+
+    // A read-only request does not reach the store at all
+    down := fiber.New()
+    down.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           downStore{store},
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        Lazy:            true,
+    }))
+    down.Get("/health", func(c *fiber.Ctx) error {
+        return c.SendString("ok")
+    })
+    if resp, _ := doRequest(t, down, "GET", "/health", nil); resp.StatusCode != fiber.StatusOK {
+        t.Errorf("read-only request with the store down status = %d; want %d", resp.StatusCode, fiber.StatusOK)
+    }
+}
+
+func TestSignedSessionCookie(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    signer, err := NewSigner([]byte(strings.Repeat("k", 32)))
+    if err != nil {
+        t.Fatalf("NewSigner() error = %v", err)
+    }
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        Signer:          signer,
+    }))
+    app.Get("/", func(c *fiber.Ctx) error {
+        return c.SendString(MustGetSessionID(c))
+    })
+
+    resp, sessionID := doRequest(t, app, "GET", "/", nil)
+    cookie := sessionCookie(resp, "sid")
+    if cookie == nil || cookie.Value != signer.Sign(sessionID) {
+        t.Fatalf("session cookie is not signed")
+    }
+
+    if _, body := doRequest(t, app, "GET", "/", []*http.Cookie{cookie}); body != sessionID {
+        t.Errorf("signed cookie was not accepted: got %q, want %q", body, sessionID)
+    }
+
+    for _, value := range []string{sessionID, sessionID + ".forged", "garbage"} {
+        resp, body := doRequest(t, app, "GET", "/", []*http.Cookie{{Name: "sid", Value: value}})
+        if body == sessionID || body == value {
+            t.Errorf("cookie %q was accepted", value)
+        }
+        if sessionCookie(resp, "sid") == nil {
+            t.Errorf("no new session was issued for cookie %q", value)
+        }
+    }
+}
+
+func TestSessionHooks(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    var events []string
+    hooks := SessionHooks{
+        OnCreate: func(ctx context.Context, sessionID string) error {
+            events = append(events, "create")
+            return nil
+        },
+        OnRotate: func(ctx context.Context, oldSessionID, newSessionID string) error {
+            events = append(events, "rotate")
+            return nil
+        },
+        OnRefresh: func(ctx context.Context, sessionID string) error {
+            events = append(events, "refresh")
+            return nil
+        },
+        OnDestroy: func(ctx context.Context, sessionID string) error {
+            events = append(events, "destroy")
+            return fiber.ErrTeapot
+        },
+    }
+
+    for _, fatal := range []bool{false, true} {
+        events = nil
+
+        app := fiber.New()
+        app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+            Store:           store,
+            CookieName:      "sid",
+            SessionDuration: time.Hour,
+            RegenerateAfter: time.Hour,
+            Hooks:           hooks,
+            HookErrorsFatal: fatal,
+        }))
+        app.Get("/", func(c *fiber.Ctx) error {
+            return nil
+        })
+        app.Get("/login", func(c *fiber.Ctx) error {
+            _, err := Regenerate(c, true)
+            return err
+        })
+        app.Get("/logout", func(c *fiber.Ctx) error {
+            return Destroy(c)
+        })
+
+        resp, _ := doRequest(t, app, "GET", "/", nil)
+        resp, _ = doRequest(t, app, "GET", "/login", []*http.Cookie{sessionCookie(resp, "sid")})
+        resp, _ = doRequest(t, app, "GET", "/logout", []*http.Cookie{sessionCookie(resp, "sid")})
+
+        if got := strings.Join(events, ","); got != "create,refresh,rotate,refresh,destroy" {
+            t.Errorf("fatal=%v: events = %q; want %q", fatal, got, "create,refresh,rotate,refresh,destroy")
+        }
+
+        want := fiber.StatusOK
+        if fatal {
+            want = fiber.StatusTeapot
+        }
+        if resp.StatusCode != want {
+            t.Errorf("fatal=%v: status after failing hook = %d; want %d", fatal, resp.StatusCode, want)
+        }
+    }
+}
+
+func TestThrottledRefresh(t *testing.T) {
+    newApp := func(store Store, threshold float64, interval time.Duration, refreshes *int) *fiber.App {
+        app := fiber.New()
+        app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+            Store:            store,
+            CookieName:       "sid",
+            SessionDuration:  time.Hour,
+            RegenerateAfter:  time.Hour,
+            RefreshThreshold: threshold,
+            RefreshInterval:  interval,
+            Hooks: SessionHooks{
+                OnRefresh: func(ctx context.Context, sessionID string) error {
+                    *refreshes++
+                    return nil
+                },
+            },
+        }))
+        app.Get("/", func(c *fiber.Ctx) error {
+            return c.SendString(MustGetSessionID(c))
+        })
+        return app
+    }
+
+    t.Run("Threshold", func(t *testing.T) {
+        store := NewMemoryStore(0)
+        defer store.Close()
+
+        var refreshes int
+        app := newApp(store, 0.5, 0, &refreshes)
+
+        resp, sessionID := doRequest(t, app, "GET", "/", nil)
+        cookies := []*http.Cookie{sessionCookie(resp, "sid")}
+
+        // Plenty of TTL left, nothing to do
+        doRequest(t, app, "GET", "/", cookies)
+        if refreshes != 0 {
+            t.Errorf("refreshes with a fresh TTL = %d; want 0", refreshes)
+        }
+
+        if err := store.Expire(context.Background(), sessionID, 10*time.Minute); err != nil {
+            t.Fatalf("Expire() error = %v", err)
+        }
+        doRequest(t, app, "GET", "/", cookies)
+        if refreshes != 1 {
+            t.Errorf("refreshes below the threshold = %d; want 1", refreshes)
+        }
+
+        store.mu.RLock()
+        remaining := time.Until(store.sessions[sessionID].expiresAt)
+        store.mu.RUnlock()
+        if remaining < 50*time.Minute {
+            t.Errorf("remaining TTL after refresh = %s; want about 1h", remaining)
+        }
+    })
+
+    t.Run("Interval", func(t *testing.T) {
+        store := NewMemoryStore(0)
+        defer store.Close()
+
+        var refreshes int
+        app := newApp(store, 0, 30*time.Minute, &refreshes)
+
+        resp, _ := doRequest(t, app, "GET", "/", nil)
+        cookies := []*http.Cookie{sessionCookie(resp, "sid")}
+
+        // The first request seen by this process refreshes, later ones are throttled
+        for i := 0; i < 3; i++ {
+            doRequest(t, app, "GET", "/", cookies)
+        }
+        if refreshes != 1 {
+            t.Errorf("refreshes within the interval = %d; want 1", refreshes)
+        }
+    })
+
+    t.Run("IntervalTooLong", func(t *testing.T) {
+        defer func() {
+            if recover() == nil {
+                t.Errorf("NewSessionMiddleware() accepted a RefreshInterval beyond SessionDuration")
+            }
+        }()
+
+        newApp(NewMemoryStore(0), 0, 2*time.Hour, new(int))
+    })
+}
+
+func TestUnknownSessionIDIsReplaced(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Get("/", func(c *fiber.Ctx) error {
+        return c.SendString(MustGetSessionID(c))
+    })
+
+    // An ID the store does not know is never adopted, it may be fixated
+    resp, body := doRequest(t, app, "GET", "/", []*http.Cookie{{Name: "sid", Value: "fixated"}})
+    cookie := sessionCookie(resp, "sid")
+    if body == "fixated" || cookie == nil || cookie.Value != body {
+        t.Errorf("session ID = %q, cookie = %v; want a new ID in the cookie", body, cookie)
+    }
+}
+
+// contextStore records the context of the last HSet
+type contextStore struct {
+    *MemoryStore
+    ctx context.Context
+}
+
+func (s *contextStore) HSet(ctx context.Context, sessionID string, values map[string]string) error {
+    s.ctx = ctx
+    return s.MemoryStore.HSet(ctx, sessionID, values)
+}
+
+func TestRequestContext(t *testing.T) {
+    store := &contextStore{MemoryStore: NewMemoryStore(0)}
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(func(c *fiber.Ctx) error {
+        c.Locals("requestid", "req-1")
+        return c.Next()
+    })
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:            store,
+        CookieName:       "sid",
+        SessionDuration:  time.Hour,
+        RegenerateAfter:  time.Hour,
+        OperationTimeout: time.Second,
+    }))
+    app.Get("/", func(c *fiber.Ctx) error {
+        ctx := c.UserContext()
+        if SessionIDFromContext(ctx) != MustGetSessionID(c) || logx.GetRequestID(ctx) != "req-1" {
+            return c.SendString("user context without session or request ID")
+        }
+        // Goroutines may keep the user context, the recycled Fiber context must not be in it
+        if _, ok := FiberCtxFrom(ctx); ok {
+            return c.SendString("user context carries the Fiber context")
+        }
+        return c.SendString(MustGetSessionID(c))
+    })
+
+    _, sessionID := doRequest(t, app, "GET", "/", nil)
+    if len(sessionID) != 64 {
+        t.Fatalf("body = %q; want the session ID", sessionID)
+    }
+
+    if store.ctx == nil {
+        t.Fatalf("store was not called")
+    }
+    if got := SessionIDFromContext(store.ctx); got != sessionID {
+        t.Errorf("store context session ID = %q; want %q", got, sessionID)
+    }
+    if got := logx.GetRequestID(store.ctx); got != "req-1" {
+        t.Errorf("store context request ID = %q; want %q", got, "req-1")
+    }
+
+    if deadline, ok := store.ctx.Deadline(); !ok || time.Until(deadline) > time.Second {
+        t.Errorf("store context deadline = %v, %v; want one within the OperationTimeout", deadline, ok)
+    }
+}
@@ -0,0 +1,783 @@
+// Package sessiontest provides a conformance test suite for
+// sessionutils.Store implementations.
+package sessiontest
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "slices"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    sessionutils "github.com/jsuto/go-kit/pkg/session"
+)
+
+// ErrKeyNotFound is the sentinel every Store must return (wrapped) from
+// Load, LoadJSON and HGet when the session or the field does not exist
+var ErrKeyNotFound = sessionutils.ErrKeyNotFound
+
+// Factory creates a fresh Store for a single test. The returned context is
+// passed to every Store call, so backends that keep request-scoped state
+// (e.g. in a fiber.Ctx) can supply it there.
+type Factory func(t *testing.T) (sessionutils.Store, context.Context)
+
+// RunStoreTests runs the standard battery of behavioral tests against the
+// Store implementation created by newStore. The expected behavior is that
+// of the Redis-backed sessionutils.SessionManager, which the package tests
+// run it against when REDIS_ADDR is set. Cases for optional interfaces
+// (Rotator, Toucher, UserIndex, Updater) are skipped for stores without them.
+func RunStoreTests(t *testing.T, newStore Factory) {
+    tests := []struct {
+        name string
+        fn   func(t *testing.T, store sessionutils.Store, ctx context.Context)
+    }{
+        {"SaveLoad", testSaveLoad},
+        {"LoadJSON", testLoadJSON},
+        {"LoadMissing", testLoadMissing},
+        {"HGetMissing", testHGetMissing},
+        {"HSetHGetAll", testHSetHGetAll},
+        {"HGetAllMissing", testHGetAllMissing},
+        {"Delete", testDelete},
+        {"Clear", testClear},
+        {"ClearUnknown", testClearUnknown},
+        {"ExpireRemovesSession", testExpireRemovesSession},
+        {"ExpireRefreshesTTL", testExpireRefreshesTTL},
+        {"ExpireUnknown", testExpireUnknown},
+        {"RotateSession", testRotateSession},
+        {"RotateSessionGrace", testRotateSessionGrace},
+        {"Touch", testTouch},
+        {"TouchMissing", testTouchMissing},
+        {"TouchMismatch", testTouchMismatch},
+        {"TouchRefreshBelow", testTouchRefreshBelow},
+        {"UserIndex", testUserIndex},
+        {"Update", testUpdate},
+        {"UpdateConcurrent", testUpdateConcurrent},
+        {"UpdateSession", testUpdateSession},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store, ctx := newStore(t)
+            tt.fn(t, store, ctx)
+        })
+    }
+}
+
+// RememberFactory creates a fresh RememberStore for a single test, like Factory
+type RememberFactory func(t *testing.T) (sessionutils.RememberStore, context.Context)
+
+// RunRememberStoreTests runs the behavioral tests of remember-me series
+// against the RememberStore created by newStore
+func RunRememberStoreTests(t *testing.T, newStore RememberFactory) {
+    tests := []struct {
+        name string
+        fn   func(t *testing.T, store sessionutils.RememberStore, ctx context.Context)
+    }{
+        {"ConsumeRotates", testConsumeRotates},
+        {"ConsumeGrace", testConsumeGrace},
+        {"ConsumeReused", testConsumeReused},
+        {"ConsumeForged", testConsumeForged},
+        {"ConsumeUnknown", testConsumeUnknown},
+        {"DeleteSeries", testDeleteSeries},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            store, ctx := newStore(t)
+            tt.fn(t, store, ctx)
+        })
+    }
+}
+
+// newSessionID returns a random session ID, so suites run against a shared
+// backend do not collide
+func newSessionID(t *testing.T) string {
+    t.Helper()
+
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        t.Fatalf("failed to generate session ID: %v", err)
+    }
+    return "sessiontest-" + hex.EncodeToString(b)
+}
+
+func testSaveLoad(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if err := store.Save(ctx, id, "name", "alice"); err != nil {
+        t.Fatalf("Save() error = %v", err)
+    }
+
+    raw, err := store.Load(ctx, id, "name")
+    if err != nil {
+        t.Fatalf("Load() error = %v", err)
+    }
+    if string(raw) != `"alice"` {
+        t.Errorf("Load() = %s; want %s", raw, `"alice"`)
+    }
+}
+
+func testLoadJSON(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    type cart struct {
+        Items []string `json:"items"`
+        Total int64    `json:"total"`
+    }
+
+    id := newSessionID(t)
+    want := cart{Items: []string{"apple", "pear"}, Total: 42}
+
+    if err := store.Save(ctx, id, "cart", want); err != nil {
+        t.Fatalf("Save() error = %v", err)
+    }
+
+    var got cart
+    if err := store.LoadJSON(ctx, id, "cart", &got); err != nil {
+        t.Fatalf("LoadJSON() error = %v", err)
+    }
+    if len(got.Items) != 2 || got.Items[0] != "apple" || got.Items[1] != "pear" || got.Total != 42 {
+        t.Errorf("LoadJSON() = %+v; want %+v", got, want)
+    }
+}
+
+func testLoadMissing(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if _, err := store.Load(ctx, id, "missing"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("Load() on unknown session error = %v; want ErrKeyNotFound", err)
+    }
+
+    var dest string
+    if err := store.LoadJSON(ctx, id, "missing", &dest); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("LoadJSON() on unknown session error = %v; want ErrKeyNotFound", err)
+    }
+
+    if err := store.Save(ctx, id, "present", 1); err != nil {
+        t.Fatalf("Save() error = %v", err)
+    }
+    if _, err := store.Load(ctx, id, "missing"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("Load() on unknown field error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testHGetMissing(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if _, err := store.HGet(ctx, id, "missing"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() on unknown session error = %v; want ErrKeyNotFound", err)
+    }
+
+    if err := store.HSet(ctx, id, map[string]string{"present": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if _, err := store.HGet(ctx, id, "missing"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() on unknown field error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testHSetHGetAll(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1", "b": "2"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.HSet(ctx, id, map[string]string{"b": "3"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    value, err := store.HGet(ctx, id, "b")
+    if err != nil || value != "3" {
+        t.Errorf("HGet() = %q, %v; want %q, nil", value, err, "3")
+    }
+
+    all, err := store.HGetAll(ctx, id)
+    if err != nil {
+        t.Fatalf("HGetAll() error = %v", err)
+    }
+    if len(all) != 2 || all["a"] != "1" || all["b"] != "3" {
+        t.Errorf("HGetAll() = %v; want map[a:1 b:3]", all)
+    }
+}
+
+func testHGetAllMissing(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    all, err := store.HGetAll(ctx, newSessionID(t))
+    if err != nil {
+        t.Fatalf("HGetAll() on unknown session error = %v; want nil", err)
+    }
+    if len(all) != 0 {
+        t.Errorf("HGetAll() on unknown session = %v; want empty map", all)
+    }
+}
+
+func testDelete(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1", "b": "2"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Delete(ctx, id, "a"); err != nil {
+        t.Fatalf("Delete() error = %v", err)
+    }
+
+    if _, err := store.HGet(ctx, id, "a"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() after Delete() error = %v; want ErrKeyNotFound", err)
+    }
+    if value, err := store.HGet(ctx, id, "b"); err != nil || value != "2" {
+        t.Errorf("HGet() of untouched field = %q, %v; want %q, nil", value, err, "2")
+    }
+
+    if err := store.Delete(ctx, newSessionID(t), "a"); err != nil {
+        t.Errorf("Delete() on unknown session error = %v; want nil", err)
+    }
+}
+
+func testClear(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Clear(ctx, id); err != nil {
+        t.Fatalf("Clear() error = %v", err)
+    }
+
+    all, err := store.HGetAll(ctx, id)
+    if err != nil {
+        t.Fatalf("HGetAll() error = %v", err)
+    }
+    if len(all) != 0 {
+        t.Errorf("HGetAll() after Clear() = %v; want empty map", all)
+    }
+}
+
+func testClearUnknown(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    if err := store.Clear(ctx, newSessionID(t)); err != nil {
+        t.Errorf("Clear() on unknown session error = %v; want nil", err)
+    }
+}
+
+func testExpireRemovesSession(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Expire(ctx, id, 100*time.Millisecond); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+
+    time.Sleep(300 * time.Millisecond)
+
+    if _, err := store.HGet(ctx, id, "a"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() after TTL error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testExpireRefreshesTTL(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Expire(ctx, id, 300*time.Millisecond); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+
+    time.Sleep(200 * time.Millisecond)
+
+    if err := store.Expire(ctx, id, 300*time.Millisecond); err != nil {
+        t.Fatalf("Expire() refresh error = %v", err)
+    }
+
+    time.Sleep(200 * time.Millisecond)
+
+    if value, err := store.HGet(ctx, id, "a"); err != nil || value != "1" {
+        t.Errorf("HGet() after TTL refresh = %q, %v; want %q, nil", value, err, "1")
+    }
+}
+
+func testExpireUnknown(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    if err := store.Expire(ctx, newSessionID(t), time.Minute); err != nil {
+        t.Errorf("Expire() on unknown session error = %v; want nil", err)
+    }
+}
+
+// rotator returns store as a Rotator, skipping the test if it is none
+func rotator(t *testing.T, store sessionutils.Store) sessionutils.Rotator {
+    t.Helper()
+
+    rotator, ok := store.(sessionutils.Rotator)
+    if !ok {
+        t.Skip("store does not implement Rotator")
+    }
+    return rotator
+}
+
+// toucher returns store as a Toucher, skipping the test if it is none
+func toucher(t *testing.T, store sessionutils.Store) sessionutils.Toucher {
+    t.Helper()
+
+    toucher, ok := store.(sessionutils.Toucher)
+    if !ok {
+        t.Skip("store does not implement Toucher")
+    }
+    return toucher
+}
+
+func testRotateSession(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    rotator := rotator(t, store)
+    oldID, newID := newSessionID(t), newSessionID(t)
+
+    if err := store.HSet(ctx, oldID, map[string]string{"a": "1", "b": "2"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    got, err := rotator.RotateSession(ctx, oldID, newID, sessionutils.RotateOptions{
+        KeepData: true,
+        Fields:   map[string]string{"b": "3", "c": "4"},
+        TTL:      time.Minute,
+    })
+    if err != nil {
+        t.Fatalf("RotateSession() error = %v", err)
+    }
+    if got != newID {
+        t.Errorf("RotateSession() = %q; want the new ID", got)
+    }
+
+    values, err := store.HGetAll(ctx, newID)
+    if err != nil {
+        t.Fatalf("HGetAll() error = %v", err)
+    }
+    want := map[string]string{"a": "1", "b": "3", "c": "4"}
+    if len(values) != len(want) {
+        t.Errorf("HGetAll() of the new session = %v; want %v", values, want)
+    }
+    for k, v := range want {
+        if values[k] != v {
+            t.Errorf("HGetAll()[%q] = %q; want %q", k, values[k], v)
+        }
+    }
+
+    if values, err := store.HGetAll(ctx, oldID); err != nil || len(values) != 0 {
+        t.Errorf("HGetAll() of the old session = %v, %v; want an empty map", values, err)
+    }
+}
+
+func testRotateSessionGrace(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    rotator := rotator(t, store)
+    oldID, newID := newSessionID(t), newSessionID(t)
+
+    if err := store.HSet(ctx, oldID, map[string]string{"a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    opts := sessionutils.RotateOptions{KeepData: true, TTL: time.Minute, Grace: time.Minute}
+    if _, err := rotator.RotateSession(ctx, oldID, newID, opts); err != nil {
+        t.Fatalf("RotateSession() error = %v", err)
+    }
+    if values, err := store.HGetAll(ctx, oldID); err == nil && len(values) == 0 {
+        // e.g. CookieStore, which holds a single session
+        t.Skip("store keeps no alias of a rotated session")
+    }
+
+    // A concurrent request rotating the old ID again ends up in the same session
+    got, err := rotator.RotateSession(ctx, oldID, newSessionID(t), opts)
+    if err != nil {
+        t.Fatalf("second RotateSession() error = %v", err)
+    }
+    if got != newID {
+        t.Errorf("second RotateSession() = %q; want the first target %q", got, newID)
+    }
+
+    if value, err := store.HGet(ctx, newID, "a"); err != nil || value != "1" {
+        t.Errorf("HGet() of the target = %q, %v; want %q, nil", value, err, "1")
+    }
+}
+
+func testTouch(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    toucher := toucher(t, store)
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"user": "alice", "a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Expire(ctx, id, 300*time.Millisecond); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+
+    result, err := toucher.Touch(ctx, id, sessionutils.TouchOptions{
+        Fields:   []string{"a", "missing"},
+        Required: "user",
+        Match:    map[string]string{"user": "alice"},
+        Set:      map[string]string{"b": "2"},
+        TTL:      time.Minute,
+    })
+    if err != nil {
+        t.Fatalf("Touch() error = %v", err)
+    }
+    if !result.Matched || !result.Refreshed {
+        t.Errorf("Touch() = %+v; want matched and refreshed", result)
+    }
+    if len(result.Values) != 1 || result.Values["a"] != "1" {
+        t.Errorf("Touch() values = %v; want only a=1", result.Values)
+    }
+
+    time.Sleep(500 * time.Millisecond)
+
+    if value, err := store.HGet(ctx, id, "b"); err != nil || value != "2" {
+        t.Errorf("HGet() after Touch() = %q, %v; want %q, nil", value, err, "2")
+    }
+}
+
+func testTouchMissing(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    toucher := toucher(t, store)
+    id := newSessionID(t)
+
+    if _, err := toucher.Touch(ctx, id, sessionutils.TouchOptions{Required: "user"}); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("Touch() on unknown session error = %v; want ErrKeyNotFound", err)
+    }
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if _, err := toucher.Touch(ctx, id, sessionutils.TouchOptions{Required: "user"}); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("Touch() without the required field error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testTouchMismatch(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    toucher := toucher(t, store)
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"user": "alice"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    result, err := toucher.Touch(ctx, id, sessionutils.TouchOptions{
+        Fields:   []string{"user"},
+        Required: "user",
+        Match:    map[string]string{"user": "bob"},
+        Set:      map[string]string{"b": "2"},
+        TTL:      time.Minute,
+    })
+    if err != nil {
+        t.Fatalf("Touch() error = %v", err)
+    }
+    if result.Matched || result.Refreshed {
+        t.Errorf("Touch() = %+v; want neither matched nor refreshed", result)
+    }
+    if result.Values["user"] != "alice" {
+        t.Errorf("Touch() values = %v; want user=alice", result.Values)
+    }
+
+    if _, err := store.HGet(ctx, id, "b"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() after a mismatch error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testTouchRefreshBelow(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    toucher := toucher(t, store)
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"user": "alice"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+    if err := store.Expire(ctx, id, time.Hour); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+
+    opts := sessionutils.TouchOptions{Required: "user", TTL: time.Hour, RefreshBelow: time.Minute}
+    result, err := toucher.Touch(ctx, id, opts)
+    if err != nil {
+        t.Fatalf("Touch() error = %v", err)
+    }
+    if result.Refreshed {
+        t.Error("Touch() refreshed a session with plenty of TTL left")
+    }
+
+    if err := store.Expire(ctx, id, time.Second); err != nil {
+        t.Fatalf("Expire() error = %v", err)
+    }
+    result, err = toucher.Touch(ctx, id, opts)
+    if err != nil {
+        t.Fatalf("Touch() error = %v", err)
+    }
+    if !result.Refreshed {
+        t.Error("Touch() did not refresh a session about to expire")
+    }
+}
+
+func testUserIndex(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    index, ok := store.(sessionutils.UserIndex)
+    if !ok {
+        t.Skip("store does not implement UserIndex")
+    }
+
+    user := newSessionID(t)
+    ids := []string{newSessionID(t), newSessionID(t), newSessionID(t)}
+    slices.Sort(ids)
+    for _, id := range ids {
+        if err := index.BindUser(ctx, id, user); err != nil {
+            t.Fatalf("BindUser() error = %v", err)
+        }
+    }
+
+    list := func() []string {
+        t.Helper()
+        sessions, err := index.ListUserSessions(ctx, user)
+        if err != nil {
+            t.Fatalf("ListUserSessions() error = %v", err)
+        }
+        slices.Sort(sessions)
+        return sessions
+    }
+
+    if got := list(); !slices.Equal(got, ids) {
+        t.Errorf("ListUserSessions() = %v; want %v", got, ids)
+    }
+
+    // A cleared session and one bound to another user drop out
+    if err := store.Clear(ctx, ids[0]); err != nil {
+        t.Fatalf("Clear() error = %v", err)
+    }
+    if err := index.BindUser(ctx, ids[1], newSessionID(t)); err != nil {
+        t.Fatalf("BindUser() error = %v", err)
+    }
+    if got := list(); !slices.Equal(got, ids[2:]) {
+        t.Errorf("ListUserSessions() = %v; want %v", got, ids[2:])
+    }
+
+    if err := index.RevokeAllExcept(ctx, user, ids[2]); err != nil {
+        t.Fatalf("RevokeAllExcept() error = %v", err)
+    }
+    if got := list(); !slices.Equal(got, ids[2:]) {
+        t.Errorf("ListUserSessions() after RevokeAllExcept() = %v; want %v", got, ids[2:])
+    }
+
+    if err := index.RevokeUserSessions(ctx, user); err != nil {
+        t.Fatalf("RevokeUserSessions() error = %v", err)
+    }
+    if got := list(); len(got) != 0 {
+        t.Errorf("ListUserSessions() after RevokeUserSessions() = %v; want none", got)
+    }
+    if _, err := store.HGet(ctx, ids[2], "user_id"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() of a revoked session error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+// updater returns store as an Updater, skipping the test if it is none
+func updater(t *testing.T, store sessionutils.Store) sessionutils.Updater {
+    t.Helper()
+
+    updater, ok := store.(sessionutils.Updater)
+    if !ok {
+        t.Skip("store does not implement Updater")
+    }
+    return updater
+}
+
+func testUpdate(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    updater := updater(t, store)
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1", "b": "2"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    err := updater.Update(ctx, id, "a", func(old []byte) ([]byte, error) {
+        if string(old) != "1" {
+            t.Errorf("Update() old = %q; want %q", old, "1")
+        }
+        return []byte("3"), nil
+    })
+    if err != nil {
+        t.Fatalf("Update() error = %v", err)
+    }
+    if value, err := store.HGet(ctx, id, "a"); err != nil || value != "3" {
+        t.Errorf("HGet() after Update() = %q, %v; want %q, nil", value, err, "3")
+    }
+
+    // A nil value deletes the key
+    if err := updater.Update(ctx, id, "b", func(old []byte) ([]byte, error) { return nil, nil }); err != nil {
+        t.Fatalf("Update() error = %v", err)
+    }
+    if _, err := store.HGet(ctx, id, "b"); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() of a deleted key error = %v; want ErrKeyNotFound", err)
+    }
+
+    // An error of the update function is returned as is and changes nothing
+    errAbort := errors.New("abort")
+    if err := updater.Update(ctx, id, "a", func(old []byte) ([]byte, error) { return nil, errAbort }); !errors.Is(err, errAbort) {
+        t.Errorf("Update() error = %v; want the error of the update function", err)
+    }
+    if value, _ := store.HGet(ctx, id, "a"); value != "3" {
+        t.Errorf("HGet() after a failed Update() = %q; want %q", value, "3")
+    }
+}
+
+func testUpdateConcurrent(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    updater := updater(t, store)
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"count": "0"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    const writers = 5
+
+    var wg sync.WaitGroup
+    for i := 0; i < writers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            err := updater.Update(ctx, id, "count", func(old []byte) ([]byte, error) {
+                n, _ := strconv.Atoi(string(old))
+                return []byte(strconv.Itoa(n + 1)), nil
+            })
+            if err != nil {
+                t.Errorf("Update() error = %v", err)
+            }
+        }()
+    }
+    wg.Wait()
+
+    if value, err := store.HGet(ctx, id, "count"); err != nil || value != strconv.Itoa(writers) {
+        t.Errorf("count = %q, %v; want %d", value, err, writers)
+    }
+}
+
+func testUpdateSession(t *testing.T, store sessionutils.Store, ctx context.Context) {
+    updater := updater(t, store)
+    id := newSessionID(t)
+
+    if err := store.HSet(ctx, id, map[string]string{"a": "1", "b": "2"}); err != nil {
+        t.Fatalf("HSet() error = %v", err)
+    }
+
+    err := updater.UpdateSession(ctx, id, func(values map[string]string) error {
+        values["a"] = "3"
+        values["c"] = "4"
+        delete(values, "b")
+        return nil
+    })
+    if err != nil {
+        t.Fatalf("UpdateSession() error = %v", err)
+    }
+
+    values, err := store.HGetAll(ctx, id)
+    if err != nil {
+        t.Fatalf("HGetAll() error = %v", err)
+    }
+    if len(values) != 2 || values["a"] != "3" || values["c"] != "4" {
+        t.Errorf("HGetAll() after UpdateSession() = %v; want a=3 c=4", values)
+    }
+}
+
+// hash stands in for the hash of a validator
+func hash(t *testing.T) string {
+    t.Helper()
+    return newSessionID(t)
+}
+
+func testConsumeRotates(t *testing.T, store sessionutils.RememberStore, ctx context.Context) {
+    selector, v1, v2 := newSessionID(t), hash(t), hash(t)
+
+    if err := store.CreateSeries(ctx, selector, "alice", v1, time.Minute); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+
+    userID, rotated, err := store.ConsumeSeries(ctx, selector, v1, v2, time.Minute, 0)
+    if err != nil || !rotated || userID != "alice" {
+        t.Fatalf("ConsumeSeries() = %q, %v, %v; want %q, true, nil", userID, rotated, err, "alice")
+    }
+
+    userID, rotated, err = store.ConsumeSeries(ctx, selector, v2, hash(t), time.Minute, 0)
+    if err != nil || !rotated || userID != "alice" {
+        t.Errorf("ConsumeSeries() with the new validator = %q, %v, %v; want %q, true, nil", userID, rotated, err, "alice")
+    }
+}
+
+func testConsumeGrace(t *testing.T, store sessionutils.RememberStore, ctx context.Context) {
+    selector, v1, v2 := newSessionID(t), hash(t), hash(t)
+
+    if err := store.CreateSeries(ctx, selector, "alice", v1, time.Minute); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+    if _, _, err := store.ConsumeSeries(ctx, selector, v1, v2, time.Minute, time.Minute); err != nil {
+        t.Fatalf("ConsumeSeries() error = %v", err)
+    }
+
+    // A concurrent request with the previous validator passes without rotating
+    userID, rotated, err := store.ConsumeSeries(ctx, selector, v1, hash(t), time.Minute, time.Minute)
+    if err != nil || rotated || userID != "alice" {
+        t.Errorf("ConsumeSeries() in grace = %q, %v, %v; want %q, false, nil", userID, rotated, err, "alice")
+    }
+
+    if _, rotated, err := store.ConsumeSeries(ctx, selector, v2, hash(t), time.Minute, time.Minute); err != nil || !rotated {
+        t.Errorf("ConsumeSeries() with the current validator = %v, %v; want true, nil", rotated, err)
+    }
+}
+
+func testConsumeReused(t *testing.T, store sessionutils.RememberStore, ctx context.Context) {
+    selector, v1, v2 := newSessionID(t), hash(t), hash(t)
+
+    if err := store.CreateSeries(ctx, selector, "alice", v1, time.Minute); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+    if _, _, err := store.ConsumeSeries(ctx, selector, v1, v2, time.Minute, 0); err != nil {
+        t.Fatalf("ConsumeSeries() error = %v", err)
+    }
+
+    userID, _, err := store.ConsumeSeries(ctx, selector, v1, hash(t), time.Minute, 0)
+    if !errors.Is(err, sessionutils.ErrRememberTokenStolen) || userID != "alice" {
+        t.Errorf("ConsumeSeries() with a reused validator = %q, %v; want %q, ErrRememberTokenStolen", userID, err, "alice")
+    }
+
+    // The series is revoked
+    if _, _, err := store.ConsumeSeries(ctx, selector, v2, hash(t), time.Minute, 0); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("ConsumeSeries() after theft error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testConsumeForged(t *testing.T, store sessionutils.RememberStore, ctx context.Context) {
+    selector, v1 := newSessionID(t), hash(t)
+
+    if err := store.CreateSeries(ctx, selector, "alice", v1, time.Minute); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+
+    if _, _, err := store.ConsumeSeries(ctx, selector, hash(t), hash(t), time.Minute, 0); !errors.Is(err, sessionutils.ErrRememberTokenInvalid) {
+        t.Errorf("ConsumeSeries() with a forged validator error = %v; want ErrRememberTokenInvalid", err)
+    }
+
+    // The series survives
+    if _, rotated, err := store.ConsumeSeries(ctx, selector, v1, hash(t), time.Minute, 0); err != nil || !rotated {
+        t.Errorf("ConsumeSeries() after a forged validator = %v, %v; want true, nil", rotated, err)
+    }
+}
+
+func testConsumeUnknown(t *testing.T, store sessionutils.RememberStore, ctx context.Context) {
+    if _, _, err := store.ConsumeSeries(ctx, newSessionID(t), hash(t), hash(t), time.Minute, 0); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("ConsumeSeries() of an unknown series error = %v; want ErrKeyNotFound", err)
+    }
+}
+
+func testDeleteSeries(t *testing.T, store sessionutils.RememberStore, ctx context.Context) {
+    selector, v1 := newSessionID(t), hash(t)
+
+    if err := store.CreateSeries(ctx, selector, "alice", v1, time.Minute); err != nil {
+        t.Fatalf("CreateSeries() error = %v", err)
+    }
+    if err := store.DeleteSeries(ctx, selector); err != nil {
+        t.Fatalf("DeleteSeries() error = %v", err)
+    }
+    if _, _, err := store.ConsumeSeries(ctx, selector, v1, hash(t), time.Minute, 0); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("ConsumeSeries() of a deleted series error = %v; want ErrKeyNotFound", err)
+    }
+    if err := store.DeleteSeries(ctx, selector); err != nil {
+        t.Errorf("DeleteSeries() of an unknown series error = %v; want nil", err)
+    }
+}
@@ -2,13 +2,32 @@ package sessionutils
 
 import (
     "context"
-    "encoding/json"
+    "errors"
     "fmt"
+    "strings"
     "time"
 
     "github.com/redis/go-redis/v9"
 )
 
+// ErrKeyNotFound is returned (wrapped) by every Store when the session or
+// the requested field does not exist. Use errors.Is to check for it.
+var ErrKeyNotFound = errors.New("session key not found")
+
+// notFoundError reports a missing session key. It matches both ErrKeyNotFound
+// and redis.Nil, so callers checking for either keep working.
+type notFoundError struct {
+    key string
+}
+
+func (e *notFoundError) Error() string {
+    return fmt.Sprintf("session key %q not found", e.key)
+}
+
+func (e *notFoundError) Is(target error) bool {
+    return target == ErrKeyNotFound || target == redis.Nil
+}
+
 // Store defines a generic session store interface
 type Store interface {
     Save(ctx context.Context, sessionID, key string, value any) error
@@ -23,9 +42,88 @@ type Store interface {
     Expire(ctx context.Context, sessionID string, expiration time.Duration) error
 }
 
+// sessionKeyPrefix precedes the session ID in the Redis keys
+const sessionKeyPrefix = "session:"
+
+// rotatedToField is set on a rotated session during the grace period and holds the new session ID
+const rotatedToField = "rotated_to"
+
+// maxRotationHops limits how many rotation aliases are followed
+const maxRotationHops = 3
+
+// RotateOptions defines how a session is moved to a new ID
+type RotateOptions struct {
+    KeepData bool              // copy the data of the old session
+    Fields   map[string]string // fields to set on the new session
+    TTL      time.Duration     // TTL of the new session
+    Grace    time.Duration     // how long the old ID stays as an alias of the new one, 0 deletes it; CookieStore always deletes it
+}
+
+// Rotator is implemented by stores that can move a session to a new ID atomically
+type Rotator interface {
+    // RotateSession moves oldSessionID to newSessionID and returns the ID the
+    // session lives under afterwards. When the data is kept and oldSessionID has
+    // already been rotated, the existing target is returned and nothing changes.
+    RotateSession(ctx context.Context, oldSessionID, newSessionID string, opts RotateOptions) (string, error)
+}
+
+// rotateScript moves a session hash to a new key in a single step and keeps
+// the per-user index in sync.
+// KEYS[1] old key, KEYS[2] new key
+// ARGV[1] new ID, ARGV[2] old ID, ARGV[3] TTL (ms), ARGV[4] grace (ms), ARGV[5] keep data,
+// ARGV[6] user index key prefix, ARGV[7..] field/value pairs
+var rotateScript = redis.NewScript(extendIndexLua + `
+if ARGV[5] == "1" then
+    local target = redis.call("HGET", KEYS[1], "rotated_to")
+    if target then
+        return target
+    end
+    local data = redis.call("HGETALL", KEYS[1])
+    if #data > 0 then
+        redis.call("HSET", KEYS[2], unpack(data))
+    end
+end
+if #ARGV > 6 then
+    redis.call("HSET", KEYS[2], unpack(ARGV, 7))
+end
+if tonumber(ARGV[3]) > 0 then
+    redis.call("PEXPIRE", KEYS[2], ARGV[3])
+end
+local oldUser = redis.call("HGET", KEYS[1], "user_id")
+if oldUser then
+    redis.call("SREM", ARGV[6] .. oldUser, ARGV[2])
+end
+local newUser = redis.call("HGET", KEYS[2], "user_id")
+if newUser then
+    local index = ARGV[6] .. newUser
+    local fresh = redis.call("EXISTS", index) == 0
+    redis.call("SADD", index, ARGV[1])
+    extendIndex(index, redis.call("PTTL", KEYS[2]), fresh)
+end
+redis.call("DEL", KEYS[1])
+if tonumber(ARGV[4]) > 0 then
+    redis.call("HSET", KEYS[1], "rotated_to", ARGV[1])
+    redis.call("PEXPIRE", KEYS[1], ARGV[4])
+end
+return ARGV[1]
+`)
+
 // SessionManager handles Redis-backed sessions
 type SessionManager struct {
     RedisClient *redis.Client
+
+    // App namespaces the keys, so several applications can share a Redis
+    // database. Keys are "<app>:<tenant>:session:<id>", where the app and the
+    // tenant (see WithTenant) are left out when empty. Tenants require App,
+    // "<tenant>:session:<id>" could be a session of another app.
+    App string
+
+    // Codec encodes the values of Save and LoadJSON, defaults to JSONCodec.
+    // Values saved with another codec stay readable after switching.
+    Codec Codec
+
+    // CompressAbove compresses encoded values larger than this many bytes, 0 disables compression
+    CompressAbove int
 }
 
 // NewSessionManager creates a new Redis-backed SessionManager
@@ -35,68 +133,149 @@ func NewSessionManager(redisClient *redis.Client) *SessionManager {
     }
 }
 
-// Save saves a Go value into the session
+// appNamespace returns App, for validateTenants
+func (sm *SessionManager) appNamespace() string {
+    return sm.App
+}
+
+// namespace returns the key prefix of the app and the tenant in ctx
+func (sm *SessionManager) namespace(ctx context.Context) string {
+    return keyNamespace(sm.App, TenantFromContext(ctx))
+}
+
+// key returns the Redis key of a session
+func (sm *SessionManager) key(ctx context.Context, sessionID string) string {
+    return sm.namespace(ctx) + sessionKeyPrefix + sessionID
+}
+
+// indexPrefix returns the key prefix of the per-user indexes
+func (sm *SessionManager) indexPrefix(ctx context.Context) string {
+    return sm.namespace(ctx) + userIndexPrefix
+}
+
+// keyNamespace joins the non-empty parts of a key namespace
+func keyNamespace(app, tenant string) string {
+    var ns string
+    if app != "" {
+        ns = app + ":"
+    }
+    if tenant != "" {
+        ns += tenant + ":"
+    }
+    return ns
+}
+
+// parseSessionKey splits a session key into tenant and session ID. It does
+// not match other keys, like the user indexes. Without app only keys without
+// a tenant match, "shop:session:<id>" may belong to the app "shop".
+func parseSessionKey(app, key string) (tenant, sessionID string, ok bool) {
+    if app == "" {
+        sessionID, ok = strings.CutPrefix(key, sessionKeyPrefix)
+        return "", sessionID, ok && sessionID != ""
+    }
+
+    if key, ok = strings.CutPrefix(key, app+":"); !ok {
+        return "", "", false
+    }
+
+    if sessionID, ok = strings.CutPrefix(key, sessionKeyPrefix); !ok {
+        tenant, sessionID, ok = strings.Cut(key, ":"+sessionKeyPrefix)
+        if !ok || !validTenant(tenant) {
+            return "", "", false
+        }
+    }
+
+    return tenant, sessionID, sessionID != ""
+}
+
+// Save saves a Go value into the session using the configured codec
 func (sm *SessionManager) Save(ctx context.Context, sessionID, key string, value any) error {
-    fullKey := "session:" + sessionID
+    fullKey := sm.key(ctx, sessionID)
 
-    jsonValue, err := json.Marshal(value)
+    data, err := sm.encodeValue(value)
     if err != nil {
-        return fmt.Errorf("failed to marshal session value: %w", err)
+        return err
     }
 
-    if err := sm.RedisClient.HSet(ctx, fullKey, key, jsonValue).Err(); err != nil {
-        return fmt.Errorf("failed to save session data: %w", err)
+    if err := sm.RedisClient.HSet(ctx, fullKey, key, data).Err(); err != nil {
+        return fmt.Errorf("failed to save session data: %w", unavailable(err))
     }
 
     return nil
 }
 
-// Load loads a raw value (as []byte) from the session
+// Load loads a raw value (as []byte) from the session. Values saved with a
+// codec are returned as the codec encoded them, e.g. as JSON, decompressed.
 func (sm *SessionManager) Load(ctx context.Context, sessionID, key string) ([]byte, error) {
-    fullKey := "session:" + sessionID
+    data, err := sm.load(ctx, sessionID, key)
+    if err != nil {
+        return nil, err
+    }
+
+    payload, err := valuePayload(data)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load session data: %w", err)
+    }
+    return payload, nil
+}
+
+// load loads a value from the session in its stored form
+func (sm *SessionManager) load(ctx context.Context, sessionID, key string) ([]byte, error) {
+    fullKey := sm.key(ctx, sessionID)
 
     data, err := sm.RedisClient.HGet(ctx, fullKey, key).Result()
     if err == redis.Nil {
-        return nil, fmt.Errorf("session key %q not found", key)
+        return nil, &notFoundError{key: key}
     }
     if err != nil {
-        return nil, fmt.Errorf("failed to load session data: %w", err)
+        return nil, fmt.Errorf("failed to load session data: %w", unavailable(err))
     }
 
     return []byte(data), nil
 }
 
-// LoadJSON unmarshals a Go value from the session
+// LoadJSON decodes a Go value from the session with the codec it was saved with
 func (sm *SessionManager) LoadJSON(ctx context.Context, sessionID, key string, dest any) error {
-    raw, err := sm.Load(ctx, sessionID, key)
+    raw, err := sm.load(ctx, sessionID, key)
     if err != nil {
         return err
     }
 
-    if err := json.Unmarshal(raw, dest); err != nil {
-        return fmt.Errorf("failed to unmarshal session value: %w", err)
+    return sm.decodeValue(raw, dest)
+}
+
+func (sm *SessionManager) encodeValue(value any) ([]byte, error) {
+    data, err := encodeValue(sm.Codec, sm.CompressAbove, value)
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal session value: %w", err)
     }
+    return data, nil
+}
 
+func (sm *SessionManager) decodeValue(data []byte, dest any) error {
+    if err := decodeValue(sm.Codec, data, dest); err != nil {
+        return fmt.Errorf("failed to unmarshal session value: %w", err)
+    }
     return nil
 }
 
 // Delete deletes a key from the session
 func (sm *SessionManager) Delete(ctx context.Context, sessionID, key string) error {
-    fullKey := "session:" + sessionID
+    fullKey := sm.key(ctx, sessionID)
 
     if err := sm.RedisClient.HDel(ctx, fullKey, key).Err(); err != nil {
-        return fmt.Errorf("failed to delete session key %q: %w", key, err)
+        return fmt.Errorf("failed to delete session key %q: %w", key, unavailable(err))
     }
 
     return nil
 }
 
-// Clear deletes the entire session
+// Clear deletes the entire session and removes it from the user index
 func (sm *SessionManager) Clear(ctx context.Context, sessionID string) error {
-    fullKey := "session:" + sessionID
+    fullKey := sm.key(ctx, sessionID)
 
-    if err := sm.RedisClient.Del(ctx, fullKey).Err(); err != nil {
-        return fmt.Errorf("failed to clear session: %w", err)
+    if err := clearScript.Run(ctx, sm.RedisClient, []string{fullKey}, sm.indexPrefix(ctx), sessionID).Err(); err != nil {
+        return fmt.Errorf("failed to clear session: %w", unavailable(err))
     }
 
     return nil
@@ -104,24 +283,52 @@ func (sm *SessionManager) Clear(ctx context.Context, sessionID string) error {
 
 // HSet sets multiple fields in the session
 func (sm *SessionManager) HSet(ctx context.Context, sessionID string, values map[string]string) error {
-    fullKey := "session:" + sessionID
-    return sm.RedisClient.HSet(ctx, fullKey, values).Err()
+    fullKey := sm.key(ctx, sessionID)
+    return unavailable(sm.RedisClient.HSet(ctx, fullKey, values).Err())
 }
 
 // HGetAll gets all fields from the session
 func (sm *SessionManager) HGetAll(ctx context.Context, sessionID string) (map[string]string, error) {
-    fullKey := "session:" + sessionID
-    return sm.RedisClient.HGetAll(ctx, fullKey).Result()
+    fullKey := sm.key(ctx, sessionID)
+    values, err := sm.RedisClient.HGetAll(ctx, fullKey).Result()
+    return values, unavailable(err)
 }
 
 // HGet gets a single field from the session
 func (sm *SessionManager) HGet(ctx context.Context, sessionID, key string) (string, error) {
-    fullKey := "session:" + sessionID
-    return sm.RedisClient.HGet(ctx, fullKey, key).Result()
+    fullKey := sm.key(ctx, sessionID)
+
+    value, err := sm.RedisClient.HGet(ctx, fullKey, key).Result()
+    if err == redis.Nil {
+        return "", &notFoundError{key: key}
+    }
+    return value, unavailable(err)
 }
 
 // Expire sets an expiration time for the session
 func (sm *SessionManager) Expire(ctx context.Context, sessionID string, expiration time.Duration) error {
-    fullKey := "session:" + sessionID
-    return sm.RedisClient.Expire(ctx, fullKey, expiration).Err()
+    fullKey := sm.key(ctx, sessionID)
+    return unavailable(sm.RedisClient.Expire(ctx, fullKey, expiration).Err())
+}
+
+// RotateSession atomically moves a session to a new ID using a Lua script
+func (sm *SessionManager) RotateSession(ctx context.Context, oldSessionID, newSessionID string, opts RotateOptions) (string, error) {
+    keys := []string{sm.key(ctx, oldSessionID), sm.key(ctx, newSessionID)}
+
+    keepData := "0"
+    if opts.KeepData {
+        keepData = "1"
+    }
+
+    args := []any{newSessionID, oldSessionID, opts.TTL.Milliseconds(), opts.Grace.Milliseconds(), keepData, sm.indexPrefix(ctx)}
+    for k, v := range opts.Fields {
+        args = append(args, k, v)
+    }
+
+    target, err := rotateScript.Run(ctx, sm.RedisClient, keys, args...).Text()
+    if err != nil {
+        return "", fmt.Errorf("failed to rotate session: %w", unavailable(err))
+    }
+
+    return target, nil
 }
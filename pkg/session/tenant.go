@@ -0,0 +1,111 @@
+package sessionutils
+
+import (
+    "errors"
+    "net"
+    "strings"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// tenantField holds the tenant a session was created for
+const tenantField = "tenant"
+
+// sessionTenantKey is the Fiber locals key of the tenant of the request
+const sessionTenantKey = "session_tenant"
+
+// TenantResolver returns the tenant a request belongs to. Its errors are
+// returned by the session middleware as they are, e.g. a fiber.ErrNotFound
+// for an unknown tenant. Tenants must not be empty or contain a colon.
+type TenantResolver func(c *fiber.Ctx) (string, error)
+
+// TenantFromHost resolves the tenant from the host name. With a suffix such as
+// ".example.com", acme.example.com belongs to tenant "acme" and hosts without
+// the suffix are rejected; without one the whole host name is the tenant.
+func TenantFromHost(suffix string) TenantResolver {
+    return func(c *fiber.Ctx) (string, error) {
+        host := strings.ToLower(c.Hostname())
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+
+        if suffix == "" {
+            return host, nil
+        }
+
+        tenant, ok := strings.CutSuffix(host, strings.ToLower(suffix))
+        if !ok || tenant == "" {
+            return "", fiber.ErrNotFound
+        }
+        return tenant, nil
+    }
+}
+
+// TenantFromHeader resolves the tenant from a request header, e.g. "X-Tenant-ID".
+// Only use it behind a proxy that sets the header, clients can send any value.
+func TenantFromHeader(name string) TenantResolver {
+    return func(c *fiber.Ctx) (string, error) {
+        tenant := strings.TrimSpace(c.Get(name))
+        if tenant == "" {
+            return "", fiber.ErrBadRequest
+        }
+        return tenant, nil
+    }
+}
+
+// TenantFromPath resolves the tenant from a segment of the request path,
+// counting from 0, e.g. TenantFromPath(0) maps /acme/cart to tenant "acme"
+func TenantFromPath(segment int) TenantResolver {
+    return func(c *fiber.Ctx) (string, error) {
+        segments := strings.Split(strings.Trim(c.Path(), "/"), "/")
+        if segment < 0 || segment >= len(segments) || segments[segment] == "" {
+            return "", fiber.ErrNotFound
+        }
+        return segments[segment], nil
+    }
+}
+
+// validTenant reports whether a tenant can be used in store keys
+func validTenant(tenant string) bool {
+    return tenant != "" && !strings.ContainsAny(tenant, ": \t\r\n")
+}
+
+// validateTenants rejects tenants on a SessionManager without App: its keys
+// "<tenant>:session:<id>" could not be told apart from the keys of an app
+func (config SessionMiddlewareConfig) validateTenants() error {
+    if config.TenantResolver == nil {
+        return nil
+    }
+    if ns, ok := config.Store.(interface{ appNamespace() string }); ok && ns.appNamespace() == "" {
+        return errors.New("TenantResolver requires SessionManager.App to be set")
+    }
+    return nil
+}
+
+// resolveTenant runs the tenant resolver and records the tenant for the request
+func resolveTenant(c *fiber.Ctx, config SessionMiddlewareConfig) error {
+    if config.TenantResolver == nil {
+        return nil
+    }
+
+    tenant, err := config.TenantResolver(c)
+    if err != nil {
+        return err
+    }
+    if !validTenant(tenant) {
+        return fiber.ErrBadRequest
+    }
+    // Values taken from the request are only valid until the handler returns
+    tenant = strings.Clone(tenant)
+
+    c.Locals(sessionTenantKey, tenant)
+    c.SetUserContext(WithTenant(c.UserContext(), tenant))
+
+    return nil
+}
+
+// GetTenant returns the tenant of the request, or "" without a TenantResolver
+func GetTenant(c *fiber.Ctx) string {
+    tenant, _ := c.Locals(sessionTenantKey).(string)
+    return tenant
+}
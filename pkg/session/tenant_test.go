@@ -0,0 +1,147 @@
+package sessionutils
+
+import (
+    "context"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestTenantIsolation(t *testing.T) {
+    signer, err := NewSigner([]byte(strings.Repeat("k", 32)))
+    if err != nil {
+        t.Fatalf("NewSigner() error = %v", err)
+    }
+
+    for _, tt := range []struct {
+        name   string
+        signer *Signer
+    }{
+        {name: "TenantField"},
+        {name: "Signed", signer: signer},
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            store := NewMemoryStore(0)
+            defer store.Close()
+
+            app := fiber.New()
+            app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+                Store:           store,
+                CookieName:      "sid",
+                SessionDuration: time.Hour,
+                RegenerateAfter: time.Hour,
+                Signer:          tt.signer,
+                TenantResolver:  TenantFromPath(0),
+            }))
+            app.Get("/:tenant", func(c *fiber.Ctx) error {
+                return c.SendString(GetTenant(c) + "/" + MustGetSessionID(c))
+            })
+
+            resp, body := doRequest(t, app, "GET", "/acme", nil)
+            cookies := []*http.Cookie{sessionCookie(resp, "sid")}
+            _, acmeID, _ := strings.Cut(body, "/")
+
+            if _, again := doRequest(t, app, "GET", "/acme", cookies); again != body {
+                t.Errorf("same tenant got session %q; want %q", again, body)
+            }
+
+            resp, other := doRequest(t, app, "GET", "/globex", cookies)
+            tenant, globexID, _ := strings.Cut(other, "/")
+            if tenant != "globex" || globexID == acmeID {
+                t.Errorf("other tenant got %q; want a new globex session", other)
+            }
+            if sessionCookie(resp, "sid") == nil {
+                t.Errorf("other tenant did not get a new session cookie")
+            }
+
+            // The acme session is left alone
+            owner, err := store.HGet(context.Background(), acmeID, tenantField)
+            if err != nil || owner != "acme" {
+                t.Errorf("acme session tenant = %q, %v; want %q", owner, err, "acme")
+            }
+        })
+    }
+}
+
+func TestTenantResolverRejectsInvalidTenant(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        TenantResolver:  TenantFromPath(0),
+    }))
+    app.Get("/*", func(c *fiber.Ctx) error {
+        return c.SendString("ok")
+    })
+
+    if resp, _ := doRequest(t, app, "GET", "/a:b", nil); resp.StatusCode != fiber.StatusBadRequest {
+        t.Errorf("status for tenant with a colon = %d; want %d", resp.StatusCode, fiber.StatusBadRequest)
+    }
+    if resp, _ := doRequest(t, app, "GET", "/", nil); resp.StatusCode != fiber.StatusNotFound {
+        t.Errorf("status without tenant = %d; want %d", resp.StatusCode, fiber.StatusNotFound)
+    }
+}
+
+func TestSessionKeys(t *testing.T) {
+    tests := []struct {
+        app, tenant string
+        key         string
+    }{
+        {key: "session:abc"},
+        {app: "shop", key: "shop:session:abc"},
+        {tenant: "acme", key: "acme:session:abc"},
+        {app: "shop", tenant: "acme", key: "shop:acme:session:abc"},
+    }
+
+    for _, tt := range tests {
+        sm := &SessionManager{App: tt.app}
+        ctx := context.Background()
+        if tt.tenant != "" {
+            ctx = WithTenant(ctx, tt.tenant)
+        }
+
+        if key := sm.key(ctx, "abc"); key != tt.key {
+            t.Errorf("key() = %q; want %q", key, tt.key)
+        }
+
+        // Tenant keys without an app are ambiguous, tenants require App
+        tenant, sessionID, ok := parseSessionKey(tt.app, tt.key)
+        if tt.app == "" && tt.tenant != "" {
+            if ok {
+                t.Errorf("parseSessionKey(%q, %q) matched", tt.app, tt.key)
+            }
+            continue
+        }
+        if !ok || tenant != tt.tenant || sessionID != "abc" {
+            t.Errorf("parseSessionKey(%q, %q) = %q, %q, %v; want %q, %q, true", tt.app, tt.key, tenant, sessionID, ok, tt.tenant, "abc")
+        }
+    }
+
+    for _, key := range []string{"session_user:bob", "shop:session_user:bob", "other:session:abc"} {
+        if _, _, ok := parseSessionKey("shop", key); ok {
+            t.Errorf("parseSessionKey(%q, %q) matched", "shop", key)
+        }
+    }
+}
+
+func TestTenantsRequireApp(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Errorf("NewSessionMiddleware() accepted tenants on a SessionManager without App")
+        }
+    }()
+
+    NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:          NewSessionManager(nil),
+        CookieName:     "sid",
+        TenantResolver: TenantFromHeader("X-Tenant"),
+    })
+}
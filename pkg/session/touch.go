@@ -0,0 +1,204 @@
+package sessionutils
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// maxTouchCacheSize bounds the number of sessions the refresh throttle remembers
+const maxTouchCacheSize = 10000
+
+// TouchOptions describes the per-request work on an existing session
+type TouchOptions struct {
+    Fields       []string          // fields to read
+    Required     string            // the session counts as missing without this field
+    Match        map[string]string // fields that must have these values, otherwise nothing is written
+    Set          map[string]string // fields to write
+    TTL          time.Duration     // TTL to set, 0 keeps the current one
+    RefreshBelow time.Duration     // only set the TTL if less than this remains, 0 always sets it
+}
+
+// TouchResult is the outcome of a touch
+type TouchResult struct {
+    Values    map[string]string // the requested fields that are set
+    Matched   bool              // whether the Match fields matched, so the writes were done
+    Refreshed bool              // whether the TTL was set
+}
+
+// Toucher is implemented by stores that can read the bookkeeping fields of
+// a session and refresh it in a single round trip. It returns ErrKeyNotFound
+// if the session does not exist.
+type Toucher interface {
+    Touch(ctx context.Context, sessionID string, opts TouchOptions) (TouchResult, error)
+}
+
+// touchScript reads fields of a session and, if it matches, writes fields
+// and refreshes its TTL.
+// A refresh extends the index of the session's user along with it.
+// KEYS[1] session key
+// ARGV[1] TTL (ms), ARGV[2] refresh below (ms), ARGV[3] required field,
+// ARGV[4] number of fields, ARGV[5] number of match pairs, ARGV[6] number of set pairs,
+// ARGV[7] user index key prefix,
+// ARGV[8..] fields, match field/value pairs, set field/value pairs
+var touchScript = redis.NewScript(extendIndexLua + `
+if redis.call("HEXISTS", KEYS[1], ARGV[3]) == 0 then
+    return false
+end
+local nFields, nMatch, nSet = tonumber(ARGV[4]), tonumber(ARGV[5]), tonumber(ARGV[6])
+local i = 8
+local values = {}
+if nFields > 0 then
+    values = redis.call("HMGET", KEYS[1], unpack(ARGV, i, i + nFields - 1))
+end
+i = i + nFields
+for j = 0, nMatch - 1 do
+    if redis.call("HGET", KEYS[1], ARGV[i + 2 * j]) ~= ARGV[i + 2 * j + 1] then
+        return {0, 0, values}
+    end
+end
+i = i + 2 * nMatch
+if nSet > 0 then
+    redis.call("HSET", KEYS[1], unpack(ARGV, i, i + 2 * nSet - 1))
+end
+local refreshed = 0
+local ttl, below = tonumber(ARGV[1]), tonumber(ARGV[2])
+if ttl > 0 then
+    local remaining = redis.call("PTTL", KEYS[1])
+    if below <= 0 or remaining < 0 or remaining < below then
+        redis.call("PEXPIRE", KEYS[1], ttl)
+        refreshed = 1
+        local user = redis.call("HGET", KEYS[1], "user_id")
+        if user then
+            extendIndex(ARGV[7] .. user, ttl, false)
+        end
+    end
+end
+return {1, refreshed, values}
+`)
+
+// Touch reads, writes and refreshes a session in one round trip using a Lua script
+func (sm *SessionManager) Touch(ctx context.Context, sessionID string, opts TouchOptions) (TouchResult, error) {
+    args := []any{opts.TTL.Milliseconds(), opts.RefreshBelow.Milliseconds(), opts.Required, len(opts.Fields), len(opts.Match), len(opts.Set), sm.indexPrefix(ctx)}
+    for _, field := range opts.Fields {
+        args = append(args, field)
+    }
+    for k, v := range opts.Match {
+        args = append(args, k, v)
+    }
+    for k, v := range opts.Set {
+        args = append(args, k, v)
+    }
+
+    reply, err := touchScript.Run(ctx, sm.RedisClient, []string{sm.key(ctx, sessionID)}, args...).Slice()
+    if err == redis.Nil {
+        return TouchResult{}, &notFoundError{key: opts.Required}
+    }
+    if err != nil {
+        return TouchResult{}, fmt.Errorf("failed to touch session: %w", unavailable(err))
+    }
+    if len(reply) != 3 {
+        return TouchResult{}, fmt.Errorf("unexpected touch reply %v", reply)
+    }
+
+    result := TouchResult{
+        Values:    make(map[string]string),
+        Matched:   reply[0] == int64(1),
+        Refreshed: reply[1] == int64(1),
+    }
+
+    values, _ := reply[2].([]any)
+    for i, value := range values {
+        if s, ok := value.(string); ok && i < len(opts.Fields) {
+            result.Values[opts.Fields[i]] = s
+        }
+    }
+
+    return result, nil
+}
+
+// touch runs a touch on store, falling back to single calls for stores that
+// do not implement Toucher. The fallback cannot tell the remaining TTL, so it
+// always refreshes.
+func touch(ctx context.Context, store Store, sessionID string, opts TouchOptions) (TouchResult, error) {
+    if toucher, ok := store.(Toucher); ok {
+        return toucher.Touch(ctx, sessionID, opts)
+    }
+
+    values, err := store.HGetAll(ctx, sessionID)
+    if err != nil {
+        return TouchResult{}, err
+    }
+    if _, ok := values[opts.Required]; !ok {
+        return TouchResult{}, &notFoundError{key: opts.Required}
+    }
+
+    result := TouchResult{Values: make(map[string]string)}
+    for _, field := range opts.Fields {
+        if value, ok := values[field]; ok {
+            result.Values[field] = value
+        }
+    }
+    for k, v := range opts.Match {
+        if values[k] != v {
+            return result, nil
+        }
+    }
+    result.Matched = true
+
+    if len(opts.Set) > 0 {
+        if err := store.HSet(ctx, sessionID, opts.Set); err != nil {
+            return result, err
+        }
+    }
+    if opts.TTL > 0 {
+        if err := store.Expire(ctx, sessionID, opts.TTL); err != nil {
+            return result, err
+        }
+        result.Refreshed = true
+    }
+
+    return result, nil
+}
+
+// touchCache remembers when this process last refreshed the TTL of a session
+type touchCache struct {
+    mu      sync.Mutex
+    touched map[string]time.Time
+}
+
+func newTouchCache() *touchCache {
+    return &touchCache{touched: make(map[string]time.Time)}
+}
+
+// due reports whether the last refresh of a session is older than interval
+func (tc *touchCache) due(key string, now time.Time, interval time.Duration) bool {
+    tc.mu.Lock()
+    defer tc.mu.Unlock()
+
+    last, ok := tc.touched[key]
+    return !ok || now.Sub(last) >= interval
+}
+
+// record stores the time of a refresh. When the cache is full, entries that
+// are due anyway are dropped, and if that does not help, all of them.
+func (tc *touchCache) record(key string, now time.Time, interval time.Duration) {
+    tc.mu.Lock()
+    defer tc.mu.Unlock()
+
+    if len(tc.touched) >= maxTouchCacheSize {
+        for k, last := range tc.touched {
+            if now.Sub(last) >= interval {
+                delete(tc.touched, k)
+            }
+        }
+        if len(tc.touched) >= maxTouchCacheSize {
+            clear(tc.touched)
+        }
+    }
+
+    tc.touched[key] = now
+}
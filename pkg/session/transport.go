@@ -0,0 +1,159 @@
+package sessionutils
+
+import (
+    "strings"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// sessionTransportKey is the Fiber locals key of the transport the session ID arrived on
+const sessionTransportKey = "session_transport"
+
+// Transport carries the session ID between client and server. Values passed
+// to and returned by a transport are already signed if a Signer is configured.
+type Transport interface {
+    // Read returns the value sent by the client, or "" if there is none
+    Read(c *fiber.Ctx, config SessionMiddlewareConfig) string
+    // Write sends a new or rotated value to the client
+    Write(c *fiber.Ctx, config SessionMiddlewareConfig, value string)
+    // Clear tells the client to drop the value
+    Clear(c *fiber.Ctx, config SessionMiddlewareConfig)
+}
+
+// CookieTransport carries the session ID in the cookie described by the
+// Cookie* fields of SessionMiddlewareConfig. It is the default transport.
+type CookieTransport struct{}
+
+// Read returns the session cookie
+func (CookieTransport) Read(c *fiber.Ctx, config SessionMiddlewareConfig) string {
+    return c.Cookies(config.CookieName)
+}
+
+// Write sets the session cookie
+func (CookieTransport) Write(c *fiber.Ctx, config SessionMiddlewareConfig, value string) {
+    setSessionCookie(c, config, value)
+}
+
+// Clear expires the session cookie
+func (CookieTransport) Clear(c *fiber.Ctx, config SessionMiddlewareConfig) {
+    expireSessionCookie(c, config)
+}
+
+// HeaderTransport carries the session ID in HTTP headers, for API clients
+// that cannot rely on cookies, e.g. "X-Session-Token: <id>" or
+// "Authorization: Bearer <id>"
+type HeaderTransport struct {
+    Header         string // request header, defaults to "X-Session-Token"
+    Scheme         string // optional scheme preceding the value, e.g. "Bearer"
+    ResponseHeader string // response header for new and rotated IDs, defaults to "X-Session-Token"
+}
+
+// Read returns the session ID from the request header
+func (t HeaderTransport) Read(c *fiber.Ctx, config SessionMiddlewareConfig) string {
+    header := t.Header
+    if header == "" {
+        header = "X-Session-Token"
+    }
+
+    value := strings.TrimSpace(c.Get(header))
+    if t.Scheme == "" {
+        return value
+    }
+
+    scheme, token, ok := strings.Cut(value, " ")
+    if !ok || !strings.EqualFold(scheme, t.Scheme) {
+        return ""
+    }
+    return strings.TrimSpace(token)
+}
+
+// Write sends the session ID in the response header
+func (t HeaderTransport) Write(c *fiber.Ctx, config SessionMiddlewareConfig, value string) {
+    c.Set(t.responseHeader(), value)
+}
+
+// Clear sends an empty response header
+func (t HeaderTransport) Clear(c *fiber.Ctx, config SessionMiddlewareConfig) {
+    c.Set(t.responseHeader(), "")
+}
+
+func (t HeaderTransport) responseHeader() string {
+    if t.ResponseHeader != "" {
+        return t.ResponseHeader
+    }
+    return "X-Session-Token"
+}
+
+// transports returns the configured transports, defaulting to the cookie
+func (config SessionMiddlewareConfig) transports() []Transport {
+    if len(config.Transports) == 0 {
+        return []Transport{CookieTransport{}}
+    }
+    return config.Transports
+}
+
+// readSessionID returns the first valid session ID sent over any transport
+// and remembers the transport, so replies go back the same way
+func readSessionID(c *fiber.Ctx, config SessionMiddlewareConfig) (string, bool) {
+    for _, transport := range config.transports() {
+        value := transport.Read(c, config)
+        if value == "" {
+            continue
+        }
+
+        sessionID, ok := config.decodeSessionID(GetTenant(c), value)
+        if !ok {
+            continue
+        }
+
+        c.Locals(sessionTransportKey, transport)
+        // Request values are only valid until the handler returns, but the
+        // ID may end up in longer lived places like MemoryStore's user index
+        return strings.Clone(sessionID), true
+    }
+
+    return "", false
+}
+
+// writeSessionID sends sessionID over the transport it arrived on, or over
+// the first transport for a session the client does not know yet. Sending it
+// over every transport would e.g. expose a cookie session in a header.
+func writeSessionID(c *fiber.Ctx, config SessionMiddlewareConfig, sessionID string) {
+    value := config.encodeSessionID(GetTenant(c), sessionID)
+
+    transport, ok := c.Locals(sessionTransportKey).(Transport)
+    if !ok {
+        transport = config.transports()[0]
+    }
+    transport.Write(c, config, value)
+}
+
+// clearSessionID tells the client to drop its session ID
+func clearSessionID(c *fiber.Ctx, config SessionMiddlewareConfig) {
+    if transport, ok := c.Locals(sessionTransportKey).(Transport); ok {
+        transport.Clear(c, config)
+        return
+    }
+
+    for _, transport := range config.transports() {
+        transport.Clear(c, config)
+    }
+}
+
+// encodeSessionID returns the value carrying sessionID, signed for the
+// tenant if a Signer is configured
+func (config SessionMiddlewareConfig) encodeSessionID(tenant, sessionID string) string {
+    if config.Signer == nil {
+        return sessionID
+    }
+    return config.Signer.sign(tenant, sessionID)
+}
+
+// decodeSessionID returns the session ID carried by value, verifying its
+// signature, which only matches for the tenant it was issued to
+func (config SessionMiddlewareConfig) decodeSessionID(tenant, value string) (string, bool) {
+    if config.Signer == nil {
+        return value, true
+    }
+    return config.Signer.verify(tenant, value)
+}
@@ -0,0 +1,70 @@
+package sessionutils
+
+import (
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+func TestHeaderTransport(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        Transports: []Transport{
+            CookieTransport{},
+            HeaderTransport{Header: fiber.HeaderAuthorization, Scheme: "Bearer"},
+        },
+    }))
+    app.Get("/", func(c *fiber.Ctx) error {
+        return c.SendString(MustGetSessionID(c))
+    })
+    app.Post("/login", func(c *fiber.Ctx) error {
+        newID, err := Regenerate(c, true)
+        if err != nil {
+            return err
+        }
+        return c.SendString(newID)
+    })
+
+    // A new session is announced over the first transport only
+    resp, sessionID := doRequest(t, app, "GET", "/", nil)
+    if token := resp.Header.Get("X-Session-Token"); token != "" {
+        t.Errorf("new cookie session was exposed in X-Session-Token: %q", token)
+    }
+    if cookie := sessionCookie(resp, "sid"); cookie == nil || cookie.Value != sessionID {
+        t.Errorf("session cookie was not set for a new session")
+    }
+
+    bearer := func(method, target, token string) (string, string, bool) {
+        req := httptest.NewRequest(method, target, nil)
+        req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+        resp, err := app.Test(req)
+        if err != nil {
+            t.Fatalf("app.Test() error = %v", err)
+        }
+        buf := make([]byte, 256)
+        n, _ := resp.Body.Read(buf)
+        return string(buf[:n]), resp.Header.Get("X-Session-Token"), sessionCookie(resp, "sid") != nil
+    }
+
+    if body, _, _ := bearer("GET", "/", sessionID); body != sessionID {
+        t.Errorf("bearer token was not accepted: got %q, want %q", body, sessionID)
+    }
+
+    // A rotated ID goes back over the header only
+    newID, token, hasCookie := bearer("POST", "/login", sessionID)
+    if newID == sessionID || token != newID {
+        t.Errorf("rotated ID %q was not echoed in the header (got %q)", newID, token)
+    }
+    if hasCookie {
+        t.Errorf("rotated ID of a header session was sent as a cookie")
+    }
+}
@@ -0,0 +1,153 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "fmt"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+// Key is a typed session key descriptor, e.g.
+//
+//    var CartKey = sessionutils.Key[Cart]{Name: "cart"}
+//
+//    cart, err := CartKey.Get(c)
+type Key[T any] struct {
+    Name string
+}
+
+// Get loads the value of the key from the current session
+func (k Key[T]) Get(c *fiber.Ctx) (T, error) {
+    return Get[T](c, k.Name)
+}
+
+// GetOr loads the value of the key, or returns fallback if it is not set
+func (k Key[T]) GetOr(c *fiber.Ctx, fallback T) (T, error) {
+    return GetOr(c, k.Name, fallback)
+}
+
+// Set saves the value of the key into the current session
+func (k Key[T]) Set(c *fiber.Ctx, value T) error {
+    return Set(c, k.Name, value)
+}
+
+// Update changes the value of the key without losing concurrent changes
+func (k Key[T]) Update(c *fiber.Ctx, fn func(value T) (T, error)) error {
+    return Update(c, k.Name, fn)
+}
+
+// Delete removes the key from the current session
+func (k Key[T]) Delete(c *fiber.Ctx) error {
+    return Delete(c, k.Name)
+}
+
+// StoreFrom returns the Store of the session middleware handling the request.
+// Handlers of a lazy session middleware must write through it, so the
+// middleware can tell that the session needs to be stored.
+func StoreFrom(c *fiber.Ctx) (Store, error) {
+    config, err := getSessionConfig(c)
+    if err != nil {
+        return nil, err
+    }
+
+    if pending := pendingSessionFrom(c); pending != nil {
+        return &trackingStore{Store: config.Store, config: *config, pending: pending}, nil
+    }
+
+    return config.Store, nil
+}
+
+// currentSession resolves the store, session ID and store context of the request
+func currentSession(c *fiber.Ctx) (Store, string, context.Context, error) {
+    store, err := StoreFrom(c)
+    if err != nil {
+        return nil, "", nil, err
+    }
+
+    sessionID, err := GetSessionID(c)
+    if err != nil {
+        return nil, "", nil, err
+    }
+
+    return store, sessionID, requestContext(c), nil
+}
+
+// Get loads a typed value from the current session. It returns an error
+// wrapping ErrKeyNotFound if the key is not set.
+func Get[T any](c *fiber.Ctx, key string) (T, error) {
+    var value T
+
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return value, err
+    }
+
+    err = store.LoadJSON(ctx, sessionID, key, &value)
+    return value, err
+}
+
+// GetOr loads a typed value from the current session, or returns fallback if the key is not set
+func GetOr[T any](c *fiber.Ctx, key string, fallback T) (T, error) {
+    value, err := Get[T](c, key)
+    if errors.Is(err, ErrKeyNotFound) {
+        return fallback, nil
+    }
+    return value, err
+}
+
+// Set saves a typed value into the current session
+func Set[T any](c *fiber.Ctx, key string, value T) error {
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return err
+    }
+
+    return store.Save(ctx, sessionID, key, value)
+}
+
+// Update applies fn to a typed value of the current session, retrying if
+// another request changes the session in between. fn receives the zero value
+// if the key is not set and may run more than once. It returns
+// ErrUpdateUnsupported if the store does not implement Updater.
+func Update[T any](c *fiber.Ctx, key string, fn func(value T) (T, error)) error {
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return err
+    }
+
+    updater, ok := store.(Updater)
+    if !ok {
+        return ErrUpdateUnsupported
+    }
+
+    return updater.Update(ctx, sessionID, key, func(old []byte) ([]byte, error) {
+        var value T
+        if old != nil {
+            if err := decodeFor(store, old, &value); err != nil {
+                return nil, fmt.Errorf("failed to unmarshal session value: %w", err)
+            }
+        }
+
+        value, err := fn(value)
+        if err != nil {
+            return nil, err
+        }
+
+        data, err := encodeFor(store, value)
+        if err != nil {
+            return nil, fmt.Errorf("failed to marshal session value: %w", err)
+        }
+        return data, nil
+    })
+}
+
+// Delete removes a key from the current session
+func Delete(c *fiber.Ctx, key string) error {
+    store, sessionID, ctx, err := currentSession(c)
+    if err != nil {
+        return err
+    }
+
+    return store.Delete(ctx, sessionID, key)
+}
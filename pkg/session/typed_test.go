@@ -0,0 +1,115 @@
+package sessionutils
+
+import (
+    "net/http"
+    "strconv"
+    "testing"
+    "time"
+
+    "github.com/gofiber/fiber/v2"
+)
+
+type testCart struct {
+    Items []string `json:"items"`
+}
+
+var testCartKey = Key[testCart]{Name: "cart"}
+
+func TestTypedAccessors(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+    }))
+    app.Post("/add", func(c *fiber.Ctx) error {
+        cart, err := testCartKey.GetOr(c, testCart{})
+        if err != nil {
+            return err
+        }
+        cart.Items = append(cart.Items, c.Query("item"))
+        if err := testCartKey.Set(c, cart); err != nil {
+            return err
+        }
+
+        visits, err := GetOr(c, "visits", 0)
+        if err != nil {
+            return err
+        }
+        if err := Set(c, "visits", visits+1); err != nil {
+            return err
+        }
+
+        return c.SendString(strconv.Itoa(len(cart.Items)))
+    })
+    app.Post("/clear", func(c *fiber.Ctx) error {
+        return testCartKey.Delete(c)
+    })
+    app.Get("/", func(c *fiber.Ctx) error {
+        cart, err := testCartKey.Get(c)
+        if err != nil {
+            return c.SendString("empty")
+        }
+        visits, _ := Get[int](c, "visits")
+        return c.SendString(strconv.Itoa(len(cart.Items)) + "/" + strconv.Itoa(visits))
+    })
+
+    resp, _ := doRequest(t, app, "POST", "/add?item=apple", nil)
+    cookies := []*http.Cookie{sessionCookie(resp, "sid")}
+
+    if _, body := doRequest(t, app, "POST", "/add?item=pear", cookies); body != "2" {
+        t.Errorf("cart size = %q; want %q", body, "2")
+    }
+    if _, body := doRequest(t, app, "GET", "/", cookies); body != "2/2" {
+        t.Errorf("cart/visits = %q; want %q", body, "2/2")
+    }
+
+    doRequest(t, app, "POST", "/clear", cookies)
+    if _, body := doRequest(t, app, "GET", "/", cookies); body != "empty" {
+        t.Errorf("cart after Delete() = %q; want %q", body, "empty")
+    }
+}
+
+func TestTypedUpdate(t *testing.T) {
+    store := NewMemoryStore(0)
+    defer store.Close()
+
+    app := fiber.New()
+    app.Use(NewSessionMiddleware(SessionMiddlewareConfig{
+        Store:           store,
+        CookieName:      "sid",
+        SessionDuration: time.Hour,
+        RegenerateAfter: time.Hour,
+        Lazy:            true,
+    }))
+    app.Post("/add", func(c *fiber.Ctx) error {
+        return testCartKey.Update(c, func(cart testCart) (testCart, error) {
+            cart.Items = append(cart.Items, c.Query("item"))
+            return cart, nil
+        })
+    })
+    app.Get("/", func(c *fiber.Ctx) error {
+        cart, err := testCartKey.Get(c)
+        if err != nil {
+            return err
+        }
+        return c.SendString(strconv.Itoa(len(cart.Items)))
+    })
+
+    // Update counts as a write, so the lazy session gets stored
+    resp, _ := doRequest(t, app, "POST", "/add?item=apple", nil)
+    cookie := sessionCookie(resp, "sid")
+    if cookie == nil {
+        t.Fatalf("Update() did not store the lazy session")
+    }
+    cookies := []*http.Cookie{cookie}
+
+    doRequest(t, app, "POST", "/add?item=pear", cookies)
+    if _, body := doRequest(t, app, "GET", "/", cookies); body != "2" {
+        t.Errorf("cart size = %q; want %q", body, "2")
+    }
+}
@@ -0,0 +1,146 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "fmt"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// maxUpdateAttempts limits how often an update is retried after a conflicting write
+const maxUpdateAttempts = 10
+
+// ErrUpdateConflict is returned when an update kept losing against concurrent writes
+var ErrUpdateConflict = errors.New("session update conflict")
+
+// ErrUpdateUnsupported is returned when the configured store does not implement Updater
+var ErrUpdateUnsupported = errors.New("session store does not support updates")
+
+// Updater is implemented by stores that can read-modify-write session data
+// without losing concurrent changes. The update functions may run several
+// times, so they must not have side effects.
+type Updater interface {
+    // Update replaces the raw value of key with the result of fn. old is nil
+    // if the key is not set; returning a nil value deletes the key.
+    Update(ctx context.Context, sessionID, key string, fn func(old []byte) ([]byte, error)) error
+
+    // UpdateSession lets fn change a copy of all fields of the session and
+    // stores the changes in one transaction. Fields removed from the map are deleted.
+    UpdateSession(ctx context.Context, sessionID string, fn func(values map[string]string) error) error
+}
+
+// diffSession returns the fields to set and to delete to turn old into updated
+func diffSession(old, updated map[string]string) (map[string]string, []string) {
+    set := make(map[string]string)
+    for k, v := range updated {
+        if previous, ok := old[k]; !ok || previous != v {
+            set[k] = v
+        }
+    }
+
+    var del []string
+    for k := range old {
+        if _, ok := updated[k]; !ok {
+            del = append(del, k)
+        }
+    }
+
+    return set, del
+}
+
+// Update replaces the raw value of a session key using WATCH/MULTI, retrying
+// when the session changes in between
+func (sm *SessionManager) Update(ctx context.Context, sessionID, key string, fn func(old []byte) ([]byte, error)) error {
+    fullKey := sm.key(ctx, sessionID)
+
+    return sm.watch(ctx, fullKey, func(tx *redis.Tx) error {
+        old, err := tx.HGet(ctx, fullKey, key).Bytes()
+        if err == redis.Nil {
+            old = nil
+        } else if err != nil {
+            return fmt.Errorf("failed to load session data: %w", unavailable(err))
+        }
+
+        value, err := fn(old)
+        if err != nil {
+            return &updateFuncError{err: err}
+        }
+
+        _, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+            if value == nil {
+                pipe.HDel(ctx, fullKey, key)
+            } else {
+                pipe.HSet(ctx, fullKey, key, value)
+            }
+            return nil
+        })
+        return err
+    })
+}
+
+// UpdateSession changes several fields of a session in one WATCH/MULTI
+// transaction, retrying when the session changes in between
+func (sm *SessionManager) UpdateSession(ctx context.Context, sessionID string, fn func(values map[string]string) error) error {
+    fullKey := sm.key(ctx, sessionID)
+
+    return sm.watch(ctx, fullKey, func(tx *redis.Tx) error {
+        old, err := tx.HGetAll(ctx, fullKey).Result()
+        if err != nil {
+            return fmt.Errorf("failed to load session data: %w", unavailable(err))
+        }
+
+        values := make(map[string]string, len(old))
+        for k, v := range old {
+            values[k] = v
+        }
+        if err := fn(values); err != nil {
+            return &updateFuncError{err: err}
+        }
+
+        set, del := diffSession(old, values)
+        if len(set) == 0 && len(del) == 0 {
+            return nil
+        }
+
+        _, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+            if len(del) > 0 {
+                pipe.HDel(ctx, fullKey, del...)
+            }
+            if len(set) > 0 {
+                pipe.HSet(ctx, fullKey, set)
+            }
+            return nil
+        })
+        return err
+    })
+}
+
+// updateFuncError carries an error of an update function through the
+// transaction, so it is not mistaken for a store error
+type updateFuncError struct {
+    err error
+}
+
+func (e *updateFuncError) Error() string { return e.err.Error() }
+
+// watch runs fn in a transaction watching fullKey and retries it on conflicts
+func (sm *SessionManager) watch(ctx context.Context, fullKey string, fn func(tx *redis.Tx) error) error {
+    for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+        err := sm.RedisClient.Watch(ctx, fn, fullKey)
+        if errors.Is(err, redis.TxFailedErr) {
+            continue
+        }
+
+        var fnErr *updateFuncError
+        if errors.As(err, &fnErr) {
+            return fnErr.err
+        }
+        if err != nil {
+            return fmt.Errorf("failed to update session: %w", unavailable(err))
+        }
+        return nil
+    }
+
+    return ErrUpdateConflict
+}
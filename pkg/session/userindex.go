@@ -0,0 +1,209 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "fmt"
+
+    "github.com/gofiber/fiber/v2"
+    "github.com/redis/go-redis/v9"
+)
+
+// userIDField holds the user a session is bound to
+const userIDField = "user_id"
+
+// userIndexPrefix is the key prefix of the per-user sets of session IDs
+const userIndexPrefix = "session_user:"
+
+// ErrUserIndexUnsupported is returned when the configured store does not implement UserIndex
+var ErrUserIndexUnsupported = errors.New("session store does not support user indexes")
+
+// UserIndex is implemented by stores that keep track of the sessions of a user,
+// e.g. to log a user out everywhere after a password reset
+type UserIndex interface {
+    BindUser(ctx context.Context, sessionID, userID string) error
+    ListUserSessions(ctx context.Context, userID string) ([]string, error)
+    RevokeUserSessions(ctx context.Context, userID string) error
+    RevokeAllExcept(ctx context.Context, userID, currentSessionID string) error
+}
+
+// clearScript deletes a session and removes it from its user's index.
+// KEYS[1] session key, ARGV[1] user index key prefix, ARGV[2] session ID
+var clearScript = redis.NewScript(`
+local user = redis.call("HGET", KEYS[1], "user_id")
+redis.call("DEL", KEYS[1])
+if user then
+    redis.call("SREM", ARGV[1] .. user, ARGV[2])
+end
+return 1
+`)
+
+// extendIndexLua defines extendIndex(index, ttl), which keeps the TTL of a
+// user index at least as long as the TTL (ms) of its longest-lived session,
+// so the index expires once all of them did. A new index gets the TTL, an
+// index without one is left alone.
+const extendIndexLua = `
+local function extendIndex(index, ttl, fresh)
+    if ttl <= 0 then
+        return
+    end
+    local current = redis.call("PTTL", index)
+    if (fresh and current == -1) or (current >= 0 and current < ttl) then
+        redis.call("PEXPIRE", index, ttl)
+    end
+end
+`
+
+// bindScript binds a session to a user, moving it out of a previous user's index.
+// KEYS[1] session key, ARGV[1] user index key prefix, ARGV[2] session ID, ARGV[3] user ID
+var bindScript = redis.NewScript(extendIndexLua + `
+local previous = redis.call("HGET", KEYS[1], "user_id")
+if previous and previous ~= ARGV[3] then
+    redis.call("SREM", ARGV[1] .. previous, ARGV[2])
+end
+redis.call("HSET", KEYS[1], "user_id", ARGV[3])
+local index = ARGV[1] .. ARGV[3]
+local fresh = redis.call("EXISTS", index) == 0
+redis.call("SADD", index, ARGV[2])
+extendIndex(index, redis.call("PTTL", KEYS[1]), fresh)
+return 1
+`)
+// BindUser binds a session to a user and adds it to the user's index
+func (sm *SessionManager) BindUser(ctx context.Context, sessionID, userID string) error {
+    fullKey := sm.key(ctx, sessionID)
+
+    if err := bindScript.Run(ctx, sm.RedisClient, []string{fullKey}, sm.indexPrefix(ctx), sessionID, userID).Err(); err != nil {
+        return fmt.Errorf("failed to bind session to user: %w", unavailable(err))
+    }
+
+    return nil
+}
+
+// ListUserSessions returns the live sessions of a user. Sessions that expired
+// in the meantime are pruned from the index.
+func (sm *SessionManager) ListUserSessions(ctx context.Context, userID string) ([]string, error) {
+    indexKey := sm.indexPrefix(ctx) + userID
+
+    members, err := sm.RedisClient.SMembers(ctx, indexKey).Result()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list user sessions: %w", unavailable(err))
+    }
+    if len(members) == 0 {
+        return nil, nil
+    }
+
+    pipe := sm.RedisClient.Pipeline()
+    owners := make([]*redis.StringCmd, len(members))
+    for i, sessionID := range members {
+        owners[i] = pipe.HGet(ctx, sm.key(ctx, sessionID), userIDField)
+    }
+    if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+        return nil, fmt.Errorf("failed to list user sessions: %w", unavailable(err))
+    }
+
+    var live, stale []string
+    for i, sessionID := range members {
+        if owner, err := owners[i].Result(); err == nil && owner == userID {
+            live = append(live, sessionID)
+        } else {
+            stale = append(stale, sessionID)
+        }
+    }
+
+    if len(stale) > 0 {
+        if err := sm.RedisClient.SRem(ctx, indexKey, stale).Err(); err != nil {
+            return nil, fmt.Errorf("failed to prune user sessions: %w", unavailable(err))
+        }
+    }
+
+    return live, nil
+}
+
+// RevokeUserSessions deletes every session of a user
+func (sm *SessionManager) RevokeUserSessions(ctx context.Context, userID string) error {
+    return sm.RevokeAllExcept(ctx, userID, "")
+}
+
+// RevokeAllExcept deletes every session of a user but currentSessionID
+func (sm *SessionManager) RevokeAllExcept(ctx context.Context, userID, currentSessionID string) error {
+    _, err := sm.revokeAllExcept(ctx, userID, currentSessionID)
+    return err
+}
+
+// revokeAllExcept deletes every session of a user but currentSessionID and
+// returns the IDs it deleted. The index is watched, so a session added to it
+// meanwhile, e.g. by a rotation, is revoked as well. Should the transaction
+// fail, the IDs may or may not have been deleted, so they are returned along
+// with the error.
+func (sm *SessionManager) revokeAllExcept(ctx context.Context, userID, currentSessionID string) ([]string, error) {
+    indexKey := sm.indexPrefix(ctx) + userID
+
+    var revoked []string
+    revoke := func(tx *redis.Tx) error {
+        revoked = nil
+
+        members, err := tx.SMembers(ctx, indexKey).Result()
+        if err != nil {
+            return err
+        }
+        for _, sessionID := range members {
+            if sessionID != currentSessionID {
+                revoked = append(revoked, sessionID)
+            }
+        }
+        if len(revoked) == 0 {
+            return nil
+        }
+
+        _, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+            for _, sessionID := range revoked {
+                pipe.Del(ctx, sm.key(ctx, sessionID))
+            }
+            pipe.SRem(ctx, indexKey, revoked)
+            return nil
+        })
+        return err
+    }
+
+    for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+        err := sm.RedisClient.Watch(ctx, revoke, indexKey)
+        if errors.Is(err, redis.TxFailedErr) {
+            continue
+        }
+        if err != nil {
+            return revoked, fmt.Errorf("failed to revoke user sessions: %w", unavailable(err))
+        }
+        return revoked, nil
+    }
+
+    return nil, ErrUpdateConflict
+}
+
+// BindUser binds the current session to a user, so it can be listed and revoked
+// together with the user's other sessions. Call it after Regenerate at login.
+func BindUser(c *fiber.Ctx, userID string) error {
+    config, err := getSessionConfig(c)
+    if err != nil {
+        return err
+    }
+
+    index, ok := config.Store.(UserIndex)
+    if !ok {
+        return ErrUserIndexUnsupported
+    }
+
+    sessionID, err := GetSessionID(c)
+    if err != nil {
+        return err
+    }
+
+    ctx := requestContext(c)
+
+    if pending := pendingSessionFrom(c); pending != nil {
+        if err := pending.store(ctx, *config, sessionID); err != nil {
+            return err
+        }
+    }
+
+    return index.BindUser(ctx, sessionID, userID)
+}
@@ -0,0 +1,41 @@
+package sessionutils
+
+import (
+    "context"
+    "errors"
+    "slices"
+    "testing"
+)
+
+func TestRevokeAllExceptConcurrentRotation(t *testing.T) {
+    server := newFakeRedis(t)
+    sm := NewSessionManager(server.client())
+    ctx := context.Background()
+
+    for _, id := range []string{"current", "other"} {
+        server.HSet("session:"+id, userIDField, "alice")
+    }
+    server.SAdd("session_user:alice", "current", "other")
+
+    // A rotation moves "other" to "rotated" between reading the index and revoking
+    server.After("SMEMBERS", func() {
+        server.HSet("session:rotated", userIDField, "alice")
+        server.SAdd("session_user:alice", "rotated")
+    })
+
+    revoked, err := sm.revokeAllExcept(ctx, "alice", "current")
+    if err != nil {
+        t.Fatalf("revokeAllExcept() error = %v", err)
+    }
+    slices.Sort(revoked)
+    if want := []string{"other", "rotated"}; !slices.Equal(revoked, want) {
+        t.Errorf("revokeAllExcept() = %v; want %v", revoked, want)
+    }
+
+    if _, err := sm.HGet(ctx, "rotated", userIDField); !errors.Is(err, ErrKeyNotFound) {
+        t.Errorf("HGet() of the rotated session error = %v; want ErrKeyNotFound", err)
+    }
+    if user, err := sm.HGet(ctx, "current", userIDField); err != nil || user != "alice" {
+        t.Errorf("HGet() of the current session = %q, %v; want %q, nil", user, err, "alice")
+    }
+}